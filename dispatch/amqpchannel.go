@@ -0,0 +1,65 @@
+package main
+
+import (
+	"github.com/streadway/amqp"
+)
+
+// amqpChannel is the part of *amqp.Channel used to declare the topology,
+// consume orders and publish, so a fake broker can stand in for RabbitMQ.
+// Deliveries are settled through the channel they came from, which is
+// their amqp.Acknowledger
+type amqpChannel interface {
+	amqp.Acknowledger
+
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Cancel(consumer string, noWait bool) error
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Confirm(noWait bool) error
+	NotifyClose(c chan *amqp.Error) chan *amqp.Error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(c chan amqp.Return) chan amqp.Return
+	Close() error
+}
+
+// amqpConnection is the part of *amqp.Connection the service uses, opening
+// amqpChannels
+type amqpConnection interface {
+	Channel() (amqpChannel, error)
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	IsClosed() bool
+	Close() error
+}
+
+// amqpConn is a connection to RabbitMQ as an amqpConnection
+type amqpConn struct {
+	*amqp.Connection
+}
+
+func (c amqpConn) Channel() (amqpChannel, error) {
+	ch, err := c.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	return ch, nil
+}
+
+// dialAMQP connects to RabbitMQ at uri
+var dialAMQP = func(uri string, config amqp.Config) (amqpConnection, error) {
+	conn, err := amqp.DialConfig(uri, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return amqpConn{conn}, nil
+}
+
+var (
+	_ amqpChannel    = (*amqp.Channel)(nil)
+	_ amqpConnection = amqpConn{}
+)
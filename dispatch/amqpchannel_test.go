@@ -0,0 +1,500 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+// fakeAcknowledger records how the deliveries it was given were settled
+type fakeAcknowledger struct {
+	mu      sync.Mutex
+	settled []string
+}
+
+func (a *fakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	if multiple {
+		return a.record("ack multiple")
+	}
+	return a.record("ack")
+}
+
+func (a *fakeAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	if requeue {
+		return a.record("nack requeue")
+	}
+	return a.record("nack")
+}
+
+func (a *fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	if requeue {
+		return a.record("reject requeue")
+	}
+	return a.record("reject")
+}
+
+func (a *fakeAcknowledger) record(s string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.settled = append(a.settled, s)
+
+	return nil
+}
+
+// last returns how the most recent delivery was settled
+func (a *fakeAcknowledger) last() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.settled) == 0 {
+		return ""
+	}
+	return a.settled[len(a.settled)-1]
+}
+
+// fakeBinding is a queue bound to an exchange on a fakeChannel
+type fakeBinding struct {
+	queue    string
+	key      string
+	exchange string
+}
+
+// fakeConsumer is a consumer started on a fakeChannel
+type fakeConsumer struct {
+	queue string
+	msgs  chan amqp.Delivery
+}
+
+// fakeMessage is a message published on a fakeChannel
+type fakeMessage struct {
+	exchange  string
+	key       string
+	mandatory bool
+	msg       amqp.Publishing
+}
+
+// fakeChannel is an amqpChannel that records the topology declared on it,
+// hands out deliveries pushed with deliver and, in confirm mode, confirms
+// every publish. Deliveries are settled through its fakeAcknowledger
+type fakeChannel struct {
+	fakeAcknowledger
+
+	mu        sync.Mutex
+	closed    bool
+	prefetch  int
+	confirm   bool
+	seq       uint64
+	tag       uint64
+	exchanges map[string]string
+	queues    map[string]amqp.Table
+	bindings  []fakeBinding
+	consumers map[string]fakeConsumer
+	published []fakeMessage
+	closers   []chan *amqp.Error
+	confirms  []chan amqp.Confirmation
+	returns   []chan amqp.Return
+
+	// returned by ExchangeDeclare when set
+	declareErr error
+
+	// publishes left unconfirmed until releaseConfirms when holding
+	holding bool
+	held    []uint64
+
+	// mandatory publishes are returned as unroutable when set
+	unroutable bool
+}
+
+func newFakeChannel() *fakeChannel {
+	return &fakeChannel{
+		exchanges: map[string]string{},
+		queues:    map[string]amqp.Table{},
+		consumers: map[string]fakeConsumer{},
+	}
+}
+
+func (c *fakeChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	c.prefetch = prefetchCount
+
+	return nil
+}
+
+func (c *fakeChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	if c.declareErr != nil {
+		return c.declareErr
+	}
+	c.exchanges[name] = kind
+
+	return nil
+}
+
+func (c *fakeChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+	c.queues[name] = args
+
+	return amqp.Queue{Name: name}, nil
+}
+
+func (c *fakeChannel) QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return amqp.Queue{}, amqp.ErrClosed
+	}
+	if _, ok := c.queues[name]; !ok {
+		return amqp.Queue{}, &amqp.Error{Code: amqp.NotFound, Reason: "NOT_FOUND - no queue '" + name + "'"}
+	}
+
+	return amqp.Queue{Name: name}, nil
+}
+
+func (c *fakeChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	c.bindings = append(c.bindings, fakeBinding{name, key, exchange})
+
+	return nil
+}
+
+func (c *fakeChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+	msgs := make(chan amqp.Delivery, 16)
+	c.consumers[consumer] = fakeConsumer{queue, msgs}
+
+	return msgs, nil
+}
+
+func (c *fakeChannel) Cancel(consumer string, noWait bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	if fc, ok := c.consumers[consumer]; ok {
+		close(fc.msgs)
+		delete(c.consumers, consumer)
+	}
+
+	return nil
+}
+
+func (c *fakeChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	c.published = append(c.published, fakeMessage{exchange, key, mandatory, msg})
+
+	if c.confirm {
+		c.seq++
+		if mandatory && c.unroutable {
+			for _, returns := range c.returns {
+				returns <- amqp.Return{ReplyText: "NO_ROUTE", Exchange: exchange, RoutingKey: key}
+			}
+		}
+		if c.holding {
+			c.held = append(c.held, c.seq)
+		} else {
+			c.sendConfirm(c.seq)
+		}
+	}
+
+	return nil
+}
+
+// sendConfirm confirms tag, waiting for every receiver as the library does
+func (c *fakeChannel) sendConfirm(tag uint64) {
+	for _, confirms := range c.confirms {
+		confirms <- amqp.Confirmation{DeliveryTag: tag, Ack: true}
+	}
+}
+
+// holdConfirms leaves the publishes from now on unconfirmed until
+// releaseConfirms
+func (c *fakeChannel) holdConfirms() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.holding = true
+}
+
+// releaseConfirms confirms the held publishes and stops holding them
+func (c *fakeChannel) releaseConfirms() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, tag := range c.held {
+		c.sendConfirm(tag)
+	}
+	c.holding, c.held = false, nil
+}
+
+// returnMandatory makes the mandatory publishes from now on unroutable
+func (c *fakeChannel) returnMandatory() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.unroutable = true
+}
+
+func (c *fakeChannel) Confirm(noWait bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	c.confirm = true
+
+	return nil
+}
+
+func (c *fakeChannel) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		close(receiver)
+	} else {
+		c.closers = append(c.closers, receiver)
+	}
+
+	return receiver
+}
+
+func (c *fakeChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.confirms = append(c.confirms, confirm)
+
+	return confirm
+}
+
+func (c *fakeChannel) NotifyReturn(returns chan amqp.Return) chan amqp.Return {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.returns = append(c.returns, returns)
+
+	return returns
+}
+
+func (c *fakeChannel) Close() error {
+	c.shutdown(nil)
+	return nil
+}
+
+// shutdown closes the channel as the broker does, passing err to the
+// NotifyClose receivers unless it is nil
+func (c *fakeChannel) shutdown(err *amqp.Error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+
+	for tag, fc := range c.consumers {
+		close(fc.msgs)
+		delete(c.consumers, tag)
+	}
+	for _, receiver := range c.closers {
+		if err != nil {
+			receiver <- err
+		}
+		close(receiver)
+	}
+	for _, confirms := range c.confirms {
+		close(confirms)
+	}
+	for _, returns := range c.returns {
+		close(returns)
+	}
+}
+
+// deliver hands d to a consumer of queue, reporting whether there was one
+func (c *fakeChannel) deliver(queue string, d amqp.Delivery) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for tag, fc := range c.consumers {
+		if fc.queue != queue {
+			continue
+		}
+		c.tag++
+		d.Acknowledger = c
+		d.DeliveryTag = c.tag
+		d.ConsumerTag = tag
+		fc.msgs <- d
+		return true
+	}
+
+	return false
+}
+
+// consuming reports whether queue has a consumer on the channel
+func (c *fakeChannel) consuming(queue string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, fc := range c.consumers {
+		if fc.queue == queue {
+			return true
+		}
+	}
+
+	return false
+}
+
+// boundKeys returns the routing keys queue is bound to exchange with
+func (c *fakeChannel) boundKeys(queue string, exchange string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var keys []string
+	for _, b := range c.bindings {
+		if b.queue == queue && b.exchange == exchange {
+			keys = append(keys, b.key)
+		}
+	}
+
+	return keys
+}
+
+// messages returns what was published on the channel
+func (c *fakeChannel) messages() []fakeMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]fakeMessage(nil), c.published...)
+}
+
+// fakeConnection is an amqpConnection opening fakeChannels
+type fakeConnection struct {
+	mu       sync.Mutex
+	closed   bool
+	channels []*fakeChannel
+	closers  []chan *amqp.Error
+
+	// set as the declareErr of the channels opened
+	declareErr error
+
+	// returned by Channel when set
+	channelErr error
+}
+
+func (c *fakeConnection) Channel() (amqpChannel, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+	if c.channelErr != nil {
+		return nil, c.channelErr
+	}
+	ch := newFakeChannel()
+	ch.declareErr = c.declareErr
+	c.channels = append(c.channels, ch)
+
+	return ch, nil
+}
+
+func (c *fakeConnection) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		close(receiver)
+	} else {
+		c.closers = append(c.closers, receiver)
+	}
+
+	return receiver
+}
+
+func (c *fakeConnection) IsClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.closed
+}
+
+func (c *fakeConnection) Close() error {
+	c.shutdown(nil)
+	return nil
+}
+
+// shutdown closes the connection and its channels as the broker does,
+// passing err to the NotifyClose receivers unless it is nil
+func (c *fakeConnection) shutdown(err *amqp.Error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	channels, closers := c.channels, c.closers
+	c.mu.Unlock()
+
+	for _, ch := range channels {
+		ch.shutdown(err)
+	}
+	for _, receiver := range closers {
+		if err != nil {
+			receiver <- err
+		}
+		close(receiver)
+	}
+}
+
+// refuseChannels makes opening channels fail with err
+func (c *fakeConnection) refuseChannels(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.channelErr = err
+}
+
+// channel returns the i'th channel opened on the connection, the consumer
+// channel being the first
+func (c *fakeConnection) channel(i int) *fakeChannel {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.channels[i]
+}
+
+// dialFake makes connecting to RabbitMQ open fakeConnections for the rest
+// of the test, each passed on to the returned channel
+func dialFake(t *testing.T) <-chan *fakeConnection {
+	t.Helper()
+	dialed := make(chan *fakeConnection, 16)
+	prev := dialAMQP
+	dialAMQP = func(string, amqp.Config) (amqpConnection, error) {
+		conn := &fakeConnection{}
+		dialed <- conn
+		return conn, nil
+	}
+	t.Cleanup(func() { dialAMQP = prev })
+
+	return dialed
+}
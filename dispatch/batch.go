@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// with batchSize above 1 orders are consumed in batches of up to batchSize,
+// or fewer once batchWindow has passed since the first of them arrived
+var (
+	batchSize   int
+	batchWindow time.Duration
+)
+
+// consumeBatches collects deliveries from msgs into batches and processes
+// one batch at a time until msgs closes or ctx is done. The batches are
+// processed under orders, which outlives ctx. The deliveries of an
+// unfinished batch are left unacked for the broker to redeliver
+func consumeBatches(ctx, orders context.Context, msgs <-chan Delivery, workers chan struct{}) {
+	var batch []Delivery
+	var window <-chan time.Time
+	var timer *time.Timer
+
+	flush := func(reason string) {
+		if timer != nil {
+			timer.Stop()
+		}
+		window = nil
+		processDeliveryBatch(orders, batch, workers, reason)
+		batch = nil
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case d, ok := <-msgs:
+			if !ok {
+				return
+			}
+			d.quiet = !sampleOrderLogs()
+			logOrder(withOrderLogs(ctx, !d.quiet), "Order received", deliveryLogAttrs(d)...)
+
+			batch = append(batch, d)
+			if len(batch) == 1 {
+				timer = time.NewTimer(batchWindow)
+				window = timer.C
+			}
+			if len(batch) >= batchSize {
+				flush("size")
+			}
+		case <-window:
+			flush("window")
+		}
+	}
+}
+
+// processDeliveryBatch processes the orders of batch in parallel under one
+// consumeBatch span, linked to the span that produced each of them, then
+// settles the batch
+func processDeliveryBatch(ctx context.Context, batch []Delivery, workers chan struct{}, reason string) {
+	tracer := otel.Tracer("dispatch-service")
+
+	links := make([]trace.Link, 0, len(batch))
+	for _, d := range batch {
+		links = append(links, trace.LinkFromContext(otel.GetTextMapPropagator().Extract(context.Background(), d.Headers)))
+	}
+
+	batchCtx, span := tracer.Start(ctx, "consumeBatch",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithLinks(links...))
+	span.SetAttributes(
+		attribute.String("messaging.system", broker.System()),
+		attribute.String("messaging.destination.name", exchangeName),
+		attribute.String("messaging.operation.type", "process"),
+		attribute.Int("messaging.batch.message_count", len(batch)),
+		attribute.String("batch.flush_reason", reason),
+	)
+
+	errs := make([]error, len(batch))
+	var processing sync.WaitGroup
+	for i, d := range batch {
+		workers <- struct{}{}
+		inflight.Add(1)
+		processing.Go(func() {
+			defer inflight.Done()
+			defer func() { <-workers }()
+			errs[i] = processDelivery(withOrderLogs(batchCtx, !d.quiet), d)
+			if dryRun {
+				errs[i] = nil
+			}
+		})
+	}
+	processing.Wait()
+
+	failed := 0
+	for _, err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+	span.SetAttributes(attribute.Int("batch.failed", failed))
+	if failed > 0 {
+		span.SetStatus(codes.Error, fmt.Sprintf("%d of %d orders failed", failed, len(batch)))
+	} else {
+		span.SetStatus(codes.Ok, "")
+	}
+	span.End()
+
+	settleBatch(batch, errs)
+}
+
+// settleBatch settles the deliveries of a batch. When every order succeeded
+// the batch is acked at once, provided nothing else is consuming from the
+// channel, as the ack then covers exactly the deliveries in the batch
+func settleBatch(batch []Delivery, errs []error) {
+	last := batch[len(batch)-1]
+	if last.ackBatch != nil && len(consumedTenants())*consumers == 1 {
+		ok := true
+		for _, err := range errs {
+			ok = ok && err == nil
+		}
+		if ok {
+			if err := last.ackBatch(); err != nil {
+				slog.Error("Failed to ack batch", "size", len(batch), "error", err)
+			}
+			return
+		}
+	}
+
+	for i, d := range batch {
+		settleDelivery(d, errs[i])
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// producedDelivery returns a delivery of a new order carrying the context of
+// a span started as if by the producer
+func producedDelivery(t *testing.T) (Delivery, trace.SpanContext) {
+	t.Helper()
+	ctx, span := otel.Tracer("test").Start(context.Background(), "publish")
+	defer span.End()
+
+	headers := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, headers)
+
+	return Delivery{Headers: headers, Body: orderBody(uniqueID(t))}, span.SpanContext()
+}
+
+func TestProcessDeliveryBatchLinks(t *testing.T) {
+	spans := recordSpans(t)
+
+	var batch []Delivery
+	var produced []trace.SpanContext
+	for range 3 {
+		d, sc := producedDelivery(t)
+		batch = append(batch, d)
+		produced = append(produced, sc)
+	}
+
+	processDeliveryBatch(context.Background(), batch, make(chan struct{}, 2), "size")
+
+	for _, span := range spans.GetSpans() {
+		if span.Name != "consumeBatch" {
+			continue
+		}
+		if len(span.Links) != len(batch) {
+			t.Fatalf("consumeBatch has %d links, want %d", len(span.Links), len(batch))
+		}
+		for i, link := range span.Links {
+			if link.SpanContext.SpanID() != produced[i].SpanID() {
+				t.Errorf("link %d to span %s, want %s", i, link.SpanContext.SpanID(), produced[i].SpanID())
+			}
+		}
+		return
+	}
+	t.Error("no consumeBatch span")
+}
+
+// consumeBatch sends n orders through consumeBatches with batches of size
+// and window, returning the consumeBatch span once they have been settled
+func consumeBatch(t *testing.T, size int, window time.Duration, n int) tracetest.SpanStub {
+	t.Helper()
+	spans := recordSpans(t)
+	prevSize, prevWindow := batchSize, batchWindow
+	t.Cleanup(func() { batchSize, batchWindow = prevSize, prevWindow })
+	batchSize, batchWindow = size, window
+
+	msgs := make(chan Delivery)
+	done := make(chan struct{})
+	go func() {
+		consumeBatches(context.Background(), context.Background(), msgs, make(chan struct{}, n))
+		close(done)
+	}()
+
+	var settled sync.WaitGroup
+	for range n {
+		settled.Add(1)
+		d, _ := producedDelivery(t)
+		d.settle = func(error) { settled.Done() }
+		msgs <- d
+	}
+	settled.Wait()
+	close(msgs)
+	<-done
+
+	return findSpan(t, spans, "consumeBatch")
+}
+
+func TestConsumeBatchesFlushOnSize(t *testing.T) {
+	span := consumeBatch(t, 3, time.Hour, 3)
+
+	attrs := spanAttrs(span)
+	if got := attrs["batch.flush_reason"].AsString(); got != "size" {
+		t.Errorf("batch flushed on %q, want size", got)
+	}
+	if got := attrs["messaging.batch.message_count"].AsInt64(); got != 3 {
+		t.Errorf("batch of %d orders, want 3", got)
+	}
+}
+
+func TestConsumeBatchesFlushOnWindow(t *testing.T) {
+	start := time.Now()
+	span := consumeBatch(t, 10, 20*time.Millisecond, 2)
+
+	attrs := spanAttrs(span)
+	if got := attrs["batch.flush_reason"].AsString(); got != "window" {
+		t.Errorf("batch flushed on %q, want window", got)
+	}
+	if got := attrs["messaging.batch.message_count"].AsInt64(); got != 2 {
+		t.Errorf("batch of %d orders, want 2", got)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("batch flushed after %s, before the window closed", elapsed)
+	}
+}
+
+func TestProcessBatchLinks(t *testing.T) {
+	spans := recordSpans(t)
+
+	var orders []*Order
+	for range 3 {
+		_, span := otel.Tracer("test").Start(context.Background(), "getOrder")
+		span.End()
+		orders = append(orders, &Order{OrderID: uniqueID(t), SpanContext: span.SpanContext()})
+	}
+
+	if err := processBatch(context.Background(), orders); err != nil {
+		t.Fatal(err)
+	}
+
+	span := findSpan(t, spans, "processBatch")
+	if len(span.Links) != len(orders) {
+		t.Fatalf("processBatch has %d links, want %d", len(span.Links), len(orders))
+	}
+	for i, link := range span.Links {
+		if link.SpanContext.SpanID() != orders[i].SpanContext.SpanID() {
+			t.Errorf("link %d to span %s, want %s", i, link.SpanContext.SpanID(), orders[i].SpanContext.SpanID())
+		}
+		if len(link.Attributes) != 1 || link.Attributes[0].Value.AsString() != orders[i].OrderID {
+			t.Errorf("link %d attributes %v, want order %s", i, link.Attributes, orders[i].OrderID)
+		}
+	}
+}
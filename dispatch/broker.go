@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+
+	"github.com/streadway/amqp"
+)
+
+// broker is the transport selected by DISPATCH_BROKER
+var broker Broker
+
+// Broker is the message transport orders are consumed from and
+// confirmations are published to
+type Broker interface {
+	// System names the transport for the messaging.system attribute
+	System() string
+
+	// Consume connects in the background and delivers orders until ctx is
+	// done, reconnecting as needed
+	Consume(ctx context.Context) (<-chan Delivery, error)
+
+	// Publish sends body with the trace context of ctx to key on exchange
+	// and waits for the broker to accept it
+	Publish(ctx context.Context, exchange string, key string, body []byte) error
+
+	Close() error
+}
+
+// Delivery is an order received from a Broker
+type Delivery struct {
+	MessageID string
+	Headers   propagation.TextMapCarrier
+	Body      []byte
+
+	// encoding of Body, JSON unless application/x-protobuf
+	ContentType string
+
+	// compression of Body, if any
+	ContentEncoding string
+
+	// business correlation id set by the producer, if any
+	CorrelationID string
+
+	// priority set by the producer, 0 when there is none
+	Priority uint8
+
+	// when the order was published, zero when the producer did not say
+	Timestamp time.Time
+
+	// tenant whose queue the order came from, if any
+	Tenant string
+
+	// times the order has been delivered before
+	Redeliveries int64
+
+	// the info logs of the order were sampled out, for orders consumed in
+	// batches whose context is shared
+	quiet bool
+
+	settle func(err error)
+
+	// acks this and every earlier delivery on the channel, if the broker
+	// can
+	ackBatch func() error
+}
+
+// Settle acknowledges the delivery once processing has finished with err
+func (d Delivery) Settle(err error) {
+	if d.settle != nil {
+		d.settle(err)
+	}
+}
+
+// amqpBroker consumes orders from RabbitMQ
+type amqpBroker struct{}
+
+func (amqpBroker) System() string {
+	return "rabbitmq"
+}
+
+func (amqpBroker) Consume(ctx context.Context) (<-chan Delivery, error) {
+	// MQ error channel
+	rabbitCloseError = make(chan *amqp.Error)
+
+	// MQ ready channel, passing on each newly opened consumer channel
+	rabbitReady = make(chan amqpChannel)
+
+	go rabbitConnector(amqpUri)
+
+	rabbitCloseError <- amqp.ErrClosed
+
+	out := make(chan Delivery)
+	go func() {
+		var ch amqpChannel
+		for {
+			// wait for rabbit to be ready
+			if ch == nil {
+				select {
+				case <-ctx.Done():
+					return
+				case ch = <-rabbitReady:
+				}
+				slog.Info("Rabbit MQ ready")
+			}
+
+			// while paused keep taking the channels opened on reconnect
+			select {
+			case <-ctx.Done():
+				return
+			case ch = <-rabbitReady:
+				continue
+			case <-pauser.wait():
+			}
+
+			if !consumeChannel(ctx, ch, out) {
+				// the channel has closed, wait for the next one
+				ch = nil
+			}
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// consumeChannel forwards the orders of every tenant on ch to out until ch
+// closes or consuming is paused, returning false if ch can no longer be
+// used
+func consumeChannel(ctx context.Context, ch amqpChannel, out chan<- Delivery) bool {
+	// subscribe to the queue of each tenant, each with its own prefetch so
+	// one tenant's backlog cannot hold up the others
+	var tags []string
+	var forwarding sync.WaitGroup
+	for _, tenant := range consumedTenants() {
+		for i := range consumers {
+			tag := tenantConsumerTag(tenant, i)
+			msgs, err := ch.Consume(tenantQueue(tenant), tag, !manualAck, false, false, false, nil)
+			// the channel may have closed while consuming was paused
+			if errors.Is(err, amqp.ErrClosed) {
+				slog.Warn("Channel closed before consuming, waiting for reconnect", "error", err)
+				cancelConsumers(ch, tags)
+				forwarding.Wait()
+				return false
+			}
+			failOnError(err, "Failed to consume")
+			tags = append(tags, tag)
+
+			forwarding.Go(func() {
+				forwardDeliveries(ctx, msgs, tenant, out)
+			})
+		}
+	}
+	setConnected(true)
+
+	// cancelling the consumers closes msgs once the deliveries already
+	// received have been forwarded. Whether they were paused is kept, as
+	// consuming may be resumed again by the time they have stopped
+	var paused atomic.Bool
+	pause := func() {
+		paused.Store(true)
+		cancelConsumers(ch, tags)
+	}
+	if !pauser.running(pause) {
+		// paused while the consumers were starting
+		pause()
+	}
+	forwarding.Wait()
+	pauser.stopped()
+
+	return paused.Load()
+}
+
+// cancelConsumers stops the consumers tags on ch
+func cancelConsumers(ch amqpChannel, tags []string) {
+	for _, tag := range tags {
+		if err := ch.Cancel(tag, false); err != nil {
+			slog.Warn("Failed to cancel consumer", "consumer", tag, "error", err)
+		}
+	}
+}
+
+// tenantConsumerTag returns the tag of the i'th consumer of tenant's queue,
+// the tags must be unique on the channel
+func tenantConsumerTag(tenant string, i int) string {
+	tag := consumerTag
+	if tenant != "" {
+		tag += "-" + tenant
+	}
+	if consumers > 1 {
+		tag += "-" + strconv.Itoa(i)
+	}
+
+	return tag
+}
+
+// forwardDeliveries passes the AMQP deliveries for tenant on to out until
+// msgs closes when the channel is lost, or ctx is done
+func forwardDeliveries(ctx context.Context, msgs <-chan amqp.Delivery, tenant string, out chan<- Delivery) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case d, ok := <-msgs:
+			if !ok {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case out <- amqpDelivery(d, tenant):
+			}
+		}
+	}
+}
+
+func amqpDelivery(d amqp.Delivery, tenant string) Delivery {
+	delivery := Delivery{
+		MessageID: d.MessageId,
+		Headers:   AMQPHeaderCarrier(d.Headers),
+		Body:      d.Body,
+		Tenant:    tenant,
+
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		CorrelationID:   d.CorrelationId,
+		Priority:        d.Priority,
+		Timestamp:       d.Timestamp,
+
+		Redeliveries: retryCount(d.Headers, tenant),
+		settle: func(err error) {
+			if manualAck {
+				acknowledge(d, tenant, err)
+			}
+		},
+	}
+	if manualAck {
+		delivery.ackBatch = func() error {
+			return d.Ack(true)
+		}
+	}
+
+	return delivery
+}
+
+func (amqpBroker) Publish(ctx context.Context, exchange string, key string, body []byte) error {
+	headers := amqp.Table{}
+	otel.GetTextMapPropagator().Inject(ctx, AMQPHeaderCarrier(headers))
+
+	body, encoding, err := encodeBody(body)
+	if err != nil {
+		return err
+	}
+
+	return publishMessage(exchange, key, true, amqp.Publishing{
+		Headers:         headers,
+		ContentType:     "application/json",
+		ContentEncoding: encoding,
+		CorrelationId:   correlationID(ctx),
+		DeliveryMode:    amqp.Persistent,
+		Timestamp:       time.Now(),
+		Body:            body,
+	})
+}
+
+func (amqpBroker) Close() error {
+	conn := currentRabbitConn()
+	if conn == nil {
+		return nil
+	}
+
+	return conn.Close()
+}
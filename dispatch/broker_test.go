@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// waitFor waits for cond to hold, failing the test with what if it does not
+// within a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitConsuming waits for queue to have a consumer on ch
+func waitConsuming(t *testing.T, ch *fakeChannel, queue string) {
+	t.Helper()
+	waitFor(t, "a consumer of "+queue, func() bool { return ch.consuming(queue) })
+}
+
+// waitAcked waits for the latest delivery on ch to be acked
+func waitAcked(t *testing.T, ch *fakeChannel) {
+	t.Helper()
+	waitFor(t, "the order to be acked", func() bool { return ch.last() == "ack" })
+}
+
+func TestConsumeChannelForwardsDeliveries(t *testing.T) {
+	prevAck := manualAck
+	t.Cleanup(func() { manualAck = prevAck })
+	manualAck = true
+
+	ch := newFakeChannel()
+	out := make(chan Delivery)
+	usable := make(chan bool, 1)
+	go func() {
+		usable <- consumeChannel(context.Background(), ch, out)
+	}()
+	waitConsuming(t, ch, queueName)
+
+	ch.deliver(queueName, amqp.Delivery{MessageId: "msg-1", Body: orderBody("abc-1")})
+	select {
+	case d := <-out:
+		if d.MessageID != "msg-1" {
+			t.Errorf("forwarded message %q, want msg-1", d.MessageID)
+		}
+		d.Settle(nil)
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery not forwarded")
+	}
+	if got := ch.last(); got != "ack" {
+		t.Errorf("delivery settled with %q, want ack", got)
+	}
+
+	// losing the channel ends consuming on it
+	ch.shutdown(&amqp.Error{Code: amqp.ChannelError, Reason: "channel lost"})
+	select {
+	case ok := <-usable:
+		if ok {
+			t.Error("closed channel reported usable")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("consuming did not stop when the channel closed")
+	}
+}
+
+func TestConsumeChannelClosed(t *testing.T) {
+	ch := newFakeChannel()
+	ch.Close()
+
+	if consumeChannel(context.Background(), ch, make(chan Delivery)) {
+		t.Error("closed channel reported usable")
+	}
+}
+
+// consumeFromFake consumes orders through amqpBroker from fakeConnections
+// for the rest of the test, each passed on to the returned channel as it is
+// dialed
+func consumeFromFake(t *testing.T) <-chan *fakeConnection {
+	t.Helper()
+	dialed := dialFake(t)
+	prevAck, prevChannels := manualAck, publishChannels
+	manualAck, publishChannels = true, 1
+	useBroker(t, amqpBroker{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	msgs, err := broker.Consume(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	consumed := make(chan struct{})
+	go func() {
+		consumeOrders(ctx, context.Background(), msgs, make(chan struct{}, 4))
+		close(consumed)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-consumed
+		inflight.Wait()
+
+		// closing the connection cleanly stops rabbitConnector
+		currentRabbitConn().Close()
+		waitFor(t, "the connector to stop", func() bool { return !isConnected() })
+		closePublisher()
+		rabbitConnMu.Lock()
+		rabbitConn, rabbitChan = nil, nil
+		rabbitConnMu.Unlock()
+		manualAck, publishChannels = prevAck, prevChannels
+	})
+
+	return dialed
+}
+
+func TestAMQPBrokerReconnectsWhileConsuming(t *testing.T) {
+	dialed := consumeFromFake(t)
+
+	first := <-dialed
+	consumer := first.channel(0)
+	waitConsuming(t, consumer, queueName)
+	consumer.deliver(queueName, amqp.Delivery{Headers: amqp.Table{}, Body: orderBody(uniqueID(t))})
+	waitAcked(t, consumer)
+	if got := len(first.channel(1).messages()); got != 1 {
+		t.Fatalf("%d confirmations published, want 1", got)
+	}
+
+	// drop the connection with orders still being processed on it
+	for range 8 {
+		consumer.deliver(queueName, amqp.Delivery{Headers: amqp.Table{}, Body: orderBody(uniqueID(t))})
+	}
+	first.shutdown(&amqp.Error{Code: amqp.ConnectionForced, Reason: "CONNECTION_FORCED - broker forced connection closure"})
+
+	var second *fakeConnection
+	select {
+	case second = <-dialed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("did not reconnect")
+	}
+	consumer = second.channel(0)
+	waitConsuming(t, consumer, queueName)
+	consumer.deliver(queueName, amqp.Delivery{Headers: amqp.Table{}, Body: orderBody(uniqueID(t))})
+	waitAcked(t, consumer)
+	waitFor(t, "the confirmation on the new connection", func() bool {
+		for _, m := range second.channel(1).messages() {
+			if m.exchange == exchangeName {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func TestEscalateKeepsCause(t *testing.T) {
+	spans := recordSpans(t)
+	dialed := consumeFromFake(t)
+
+	first := <-dialed
+	waitConsuming(t, first.channel(0), queueName)
+
+	// the channel cannot be reopened, so the connection is dropped
+	cause := &amqp.Error{Code: amqp.ChannelError, Reason: "CHANNEL_ERROR - second 'channel.open' seen"}
+	first.refuseChannels(amqp.ErrClosed)
+	first.channel(0).shutdown(cause)
+
+	select {
+	case second := <-dialed:
+		waitConsuming(t, second.channel(0), queueName)
+	case <-time.After(5 * time.Second):
+		t.Fatal("did not reconnect")
+	}
+
+	// downtime is recorded once the new channel has been handed over
+	waitFor(t, "the downtime span", func() bool {
+		for _, span := range spans.GetSpans() {
+			if span.Name == "rabbitmqDowntime" {
+				return true
+			}
+		}
+		return false
+	})
+	for _, name := range []string{"reconnectRabbitMQ", "rabbitmqDowntime"} {
+		if got := spanAttrs(findSpan(t, spans, name))["rabbitmq.close_reason"].AsString(); got != cause.Reason {
+			t.Errorf("%s close reason %q, want %q", name, got, cause.Reason)
+		}
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// Config is the service configuration read from the environment
+type Config struct {
+	Broker  string
+	NATSURL string
+	AMQPURI string
+	AMQPTLS *tls.Config
+
+	AMQPHeartbeat   time.Duration
+	AMQPDialTimeout time.Duration
+
+	Exchange       string
+	ExchangeType   string
+	Queue          string
+	RoutingKeys    []string
+	Tenants        []string
+	QueueType      string
+	QueueTTL       time.Duration
+	QueueMaxLength int
+	MaxPriority    int
+	ConsumerTag    string
+
+	ManualAck      bool
+	Prefetch       int
+	MaxConcurrency int
+	Consumers      int
+	BatchSize      int
+	BatchWindow    time.Duration
+	MaxRetries     int
+	DelayedRetry   bool
+	DeadLetterArgs bool
+	RateLimit      float64
+	OrderTimeout   time.Duration
+
+	ConfirmExchange    string
+	ConfirmRoutingKey  string
+	ConfirmTargets     []confirmTarget
+	PublishGzipBytes   int
+	PublishAttempts    int
+	PublishChannels    int
+	RequeueUnconfirmed bool
+
+	ReconnectBase time.Duration
+	ReconnectMax  time.Duration
+	MaxReconnects int
+
+	QueueDepthInterval time.Duration
+
+	ErrorPercent      int
+	FailPattern       *regexp.Regexp
+	LatencyBase       int
+	LatencyJitter     int
+	DataCenterLatency map[string]int
+	BreakerThreshold  int
+	BreakerCooldown   time.Duration
+	GenerateRate      float64
+
+	IdempotencyTTL time.Duration
+	MessageIDCache int
+	RedisAddr      string
+	DatabaseDSN    string
+	OrderSchema    string
+
+	LogLevel           slog.Level
+	LogsEnabled        bool
+	LogBodies          bool
+	LogSampleN         int
+	MaxBodyBytes       int
+	DryRun             bool
+	SelfTest           bool
+	SamplingRatio      float64
+	OTLP               *otlpConfig
+	Propagator         propagation.TextMapPropagator
+	ResourceAttributes []attribute.KeyValue
+	RedactAttrs        []string
+	SpanAttrFields     [][]string
+	MetricsPrefix      string
+	HealthPort         string
+	Profiling          bool
+	AdminToken         string
+	StartupTimeout     time.Duration
+	StartupJitter      int
+	ShutdownTimeout    time.Duration
+}
+
+// loadConfig reads and validates the configuration, reporting every invalid
+// setting rather than only the first
+func loadConfig() (*Config, error) {
+	var p envParser
+	cfg := &Config{}
+
+	cfg.Broker = p.string("DISPATCH_BROKER", "amqp")
+	if cfg.Broker != "amqp" && cfg.Broker != "nats" {
+		p.fail("DISPATCH_BROKER", cfg.Broker, "must be amqp or nats")
+	}
+	cfg.NATSURL = p.string("NATS_URL", "nats://nats:4222")
+
+	scheme, defaultPort := "amqp", "5672"
+	if p.bool("AMQP_TLS", false) {
+		var err error
+		cfg.AMQPTLS, err = loadTLSConfig(os.Getenv("AMQP_TLS_CA"), os.Getenv("AMQP_TLS_CERT"), os.Getenv("AMQP_TLS_KEY"))
+		if err != nil {
+			p.errs = append(p.errs, fmt.Errorf("AMQP TLS: %w", err))
+		}
+		scheme, defaultPort = "amqps", "5671"
+	}
+	cfg.AMQPURI = amqpURI(scheme,
+		p.string("AMQP_USER", "guest"),
+		p.string("AMQP_PASSWORD", "guest"),
+		p.string("AMQP_HOST", "rabbitmq"),
+		p.port("AMQP_PORT", defaultPort),
+		p.string("AMQP_VHOST", "/"))
+	cfg.AMQPHeartbeat = p.durationRange("AMQP_HEARTBEAT", 10*time.Second, 1*time.Second, 10*time.Minute)
+	cfg.AMQPDialTimeout = p.durationRange("AMQP_DIAL_TIMEOUT", 30*time.Second, 1*time.Second, 5*time.Minute)
+
+	cfg.Exchange = p.string("DISPATCH_EXCHANGE", "robot-shop")
+	cfg.ExchangeType = p.string("DISPATCH_EXCHANGE_TYPE", "direct")
+	switch cfg.ExchangeType {
+	case "direct", "topic", "fanout":
+	default:
+		p.fail("DISPATCH_EXCHANGE_TYPE", cfg.ExchangeType, "must be direct, topic or fanout")
+	}
+	cfg.Queue = p.string("DISPATCH_QUEUE", "orders")
+	cfg.RoutingKeys = splitList(os.Getenv("DISPATCH_ROUTING_KEYS"))
+	if len(cfg.RoutingKeys) == 0 {
+		cfg.RoutingKeys = []string{p.string("DISPATCH_ROUTING_KEY", "orders")}
+	}
+	cfg.Tenants = splitList(os.Getenv("DISPATCH_TENANTS"))
+	cfg.QueueTTL = p.duration("DISPATCH_QUEUE_TTL", 0)
+	cfg.QueueMaxLength = p.int("DISPATCH_QUEUE_MAX_LENGTH", 0, 0)
+	cfg.QueueType = p.string("DISPATCH_QUEUE_TYPE", "classic")
+	switch cfg.QueueType {
+	case "classic":
+	case "quorum":
+		if cfg.QueueTTL > 0 {
+			p.fail("DISPATCH_QUEUE_TTL", cfg.QueueTTL.String(),
+				"is not supported by quorum queues before RabbitMQ 3.10, unset it or use DISPATCH_QUEUE_TYPE=classic")
+		}
+	default:
+		p.fail("DISPATCH_QUEUE_TYPE", cfg.QueueType, "must be classic or quorum")
+	}
+	if v, ok := os.LookupEnv("DISPATCH_MAX_PRIORITY"); ok {
+		cfg.MaxPriority = p.int("DISPATCH_MAX_PRIORITY", 0, 1)
+		if cfg.MaxPriority > math.MaxUint8 {
+			p.fail("DISPATCH_MAX_PRIORITY", v, "must be at most 255")
+			cfg.MaxPriority = 0
+		}
+		if cfg.MaxPriority > 0 && cfg.QueueType == "quorum" {
+			p.fail("DISPATCH_MAX_PRIORITY", v, "is not supported by quorum queues, unset it or use DISPATCH_QUEUE_TYPE=classic")
+		}
+	}
+
+	// default to a tag unique to this process
+	cfg.ConsumerTag = os.Getenv("DISPATCH_CONSUMER_TAG")
+	if cfg.ConsumerTag == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = "unknown"
+		}
+		cfg.ConsumerTag = fmt.Sprintf("%s-%s-%d", Service, hostname, os.Getpid())
+	}
+
+	cfg.ManualAck = p.bool("DISPATCH_MANUAL_ACK", true)
+	// the broker holds the prefetch count in 16 bits
+	cfg.Prefetch = min(p.int("DISPATCH_PREFETCH", 10, 1), math.MaxUint16)
+	cfg.MaxConcurrency = p.int("DISPATCH_MAX_CONCURRENCY", 32, 1)
+	cfg.Consumers = p.int("DISPATCH_CONSUMERS", 1, 1)
+	cfg.BatchSize = p.int("DISPATCH_BATCH_SIZE", 1, 1)
+	cfg.BatchWindow = p.duration("DISPATCH_BATCH_WINDOW", 100*time.Millisecond)
+	cfg.MaxRetries = p.int("DISPATCH_MAX_RETRIES", 3, 1)
+	cfg.DelayedRetry = p.bool("DISPATCH_DELAYED_RETRY", false)
+	cfg.DeadLetterArgs = p.bool("DISPATCH_DEAD_LETTER_ARGS", true)
+	cfg.RateLimit = p.float("DISPATCH_RATE_LIMIT", 0, 0, math.Inf(1))
+	cfg.OrderTimeout = p.duration("DISPATCH_ORDER_TIMEOUT", 5*time.Second)
+
+	cfg.ConfirmExchange = p.string("DISPATCH_CONFIRM_EXCHANGE", cfg.Exchange)
+	cfg.ConfirmRoutingKey = p.string("DISPATCH_CONFIRM_ROUTING_KEY", "dispatched")
+	cfg.ConfirmTargets = p.confirmTargets("DISPATCH_CONFIRM_TARGETS", confirmTarget{cfg.ConfirmExchange, cfg.ConfirmRoutingKey})
+	cfg.PublishAttempts = p.int("DISPATCH_PUBLISH_ATTEMPTS", 3, 1)
+	cfg.PublishChannels = p.int("DISPATCH_PUBLISH_CHANNELS", 4, 1)
+	cfg.PublishGzipBytes = p.int("DISPATCH_PUBLISH_GZIP_BYTES", 0, 0)
+	cfg.RequeueUnconfirmed = p.bool("DISPATCH_REQUEUE_UNCONFIRMED", true)
+
+	cfg.ReconnectBase = p.duration("DISPATCH_RECONNECT_BASE", 1*time.Second)
+	cfg.ReconnectMax = max(p.duration("DISPATCH_RECONNECT_MAX", 30*time.Second), cfg.ReconnectBase)
+	cfg.MaxReconnects = p.int("DISPATCH_MAX_RECONNECTS", 0, 0)
+
+	cfg.QueueDepthInterval = p.duration("DISPATCH_QUEUE_DEPTH_INTERVAL", 15*time.Second)
+
+	cfg.ErrorPercent = min(max(p.int("DISPATCH_ERROR_PERCENT", 0, math.MinInt), 0), 100)
+	if v := os.Getenv("DISPATCH_FAIL_PATTERN"); v != "" {
+		var err error
+		cfg.FailPattern, err = regexp.Compile(v)
+		if err != nil {
+			p.fail("DISPATCH_FAIL_PATTERN", v, "is not a valid regular expression")
+		}
+	}
+	cfg.LatencyBase = p.int("DISPATCH_LATENCY_BASE_MS", 42, 0)
+	cfg.LatencyJitter = p.int("DISPATCH_LATENCY_JITTER_MS", 42, 0)
+	cfg.DataCenterLatency = p.latencies("DISPATCH_DATACENTER_LATENCY")
+	cfg.BreakerThreshold = p.int("DISPATCH_BREAKER_THRESHOLD", 5, 1)
+	cfg.BreakerCooldown = p.duration("DISPATCH_BREAKER_COOLDOWN", 10*time.Second)
+	cfg.GenerateRate = p.float("DISPATCH_GENERATE_RATE", 0, 0, maxGenerateRate)
+
+	cfg.IdempotencyTTL = p.duration("DISPATCH_IDEMPOTENCY_TTL", 1*time.Hour)
+	cfg.MessageIDCache = p.int("DISPATCH_MESSAGE_ID_CACHE", 10000, 0)
+	cfg.RedisAddr = os.Getenv("DISPATCH_REDIS_ADDR")
+	cfg.DatabaseDSN = os.Getenv("DISPATCH_DB_DSN")
+	cfg.OrderSchema = os.Getenv("DISPATCH_ORDER_SCHEMA")
+
+	if v, ok := os.LookupEnv("LOG_LEVEL"); ok {
+		if err := cfg.LogLevel.UnmarshalText([]byte(v)); err != nil {
+			p.fail("LOG_LEVEL", v, "must be debug, info, warn or error")
+			cfg.LogLevel = slog.LevelInfo
+		}
+	}
+	cfg.LogsEnabled = p.bool("OTEL_LOGS_ENABLED", false)
+	cfg.LogBodies = p.bool("DISPATCH_LOG_BODIES", false)
+	cfg.LogSampleN = p.int("DISPATCH_LOG_SAMPLE_N", 1, 1)
+	cfg.MaxBodyBytes = p.int("DISPATCH_MAX_BODY_BYTES", 1<<20, 0)
+	cfg.DryRun = p.bool("DISPATCH_DRY_RUN", false)
+	cfg.SelfTest = p.bool("DISPATCH_SELFTEST", false)
+	cfg.SamplingRatio = p.float("OTEL_TRACES_SAMPLER_ARG", 1, 0, 1)
+	if otlp, err := loadOTLPConfig(); err != nil {
+		p.errs = append(p.errs, err)
+	} else {
+		cfg.OTLP = otlp
+	}
+	if attrs, err := parseResourceAttributes(os.Getenv("OTEL_RESOURCE_ATTRIBUTES")); err != nil {
+		p.errs = append(p.errs, fmt.Errorf("OTEL_RESOURCE_ATTRIBUTES: %w", err))
+	} else {
+		cfg.ResourceAttributes = attrs
+	}
+	cfg.RedactAttrs = splitList(os.Getenv("DISPATCH_REDACT_ATTRS"))
+	for _, field := range splitList(os.Getenv("DISPATCH_SPAN_ATTR_FIELDS")) {
+		if path, err := parseFieldPath(field); err != nil {
+			p.fail("DISPATCH_SPAN_ATTR_FIELDS", field, "has an "+err.Error())
+		} else {
+			cfg.SpanAttrFields = append(cfg.SpanAttrFields, path)
+		}
+	}
+	propagators := p.string("OTEL_PROPAGATORS", "tracecontext,baggage")
+	if prop, err := newPropagator(propagators); err != nil {
+		p.fail("OTEL_PROPAGATORS", propagators, "has an "+err.Error())
+	} else {
+		cfg.Propagator = prop
+	}
+	cfg.MetricsPrefix = p.string("DISPATCH_METRICS_PREFIX", "dispatch")
+	cfg.HealthPort = p.port("DISPATCH_HEALTH_PORT", "8080")
+	cfg.Profiling = p.bool("DISPATCH_PPROF", false)
+	cfg.AdminToken = p.string("DISPATCH_ADMIN_TOKEN", "")
+	cfg.StartupTimeout = p.duration("DISPATCH_STARTUP_TIMEOUT", 0)
+	cfg.StartupJitter = p.int("DISPATCH_STARTUP_JITTER_MS", 0, 0)
+	cfg.ShutdownTimeout = p.duration("DISPATCH_SHUTDOWN_TIMEOUT", 20*time.Second)
+
+	if err := errors.Join(p.errs...); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// envParser reads settings from the environment, keeping an error for each
+// invalid value
+type envParser struct {
+	errs []error
+}
+
+func (p *envParser) fail(key string, value string, reason string) {
+	p.errs = append(p.errs, fmt.Errorf("%s=%q %s", key, value, reason))
+}
+
+func (p *envParser) string(key string, def string) string {
+	return getEnv(key, def)
+}
+
+func (p *envParser) bool(key string, def bool) bool {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		p.fail(key, v, "is not a boolean")
+		return def
+	}
+
+	return b
+}
+
+// int returns the integer setting key, which must be at least min
+func (p *envParser) int(key string, def int, min int) int {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		p.fail(key, v, "is not an integer")
+		return def
+	}
+	if i < min {
+		p.fail(key, v, fmt.Sprintf("must be at least %d", min))
+		return def
+	}
+
+	return i
+}
+
+// float returns the number setting key, which must be from min to max
+func (p *envParser) float(key string, def float64, min float64, max float64) float64 {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(f) {
+		p.fail(key, v, "is not a number")
+		return def
+	}
+	if f < min || f > max {
+		p.fail(key, v, fmt.Sprintf("must be from %g to %g", min, max))
+		return def
+	}
+
+	return f
+}
+
+// duration returns the non negative duration setting key
+func (p *envParser) duration(key string, def time.Duration) time.Duration {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		p.fail(key, v, "is not a duration")
+		return def
+	}
+	if d < 0 {
+		p.fail(key, v, "must not be negative")
+		return def
+	}
+
+	return d
+}
+
+// durationRange returns the duration setting key, between min and max
+func (p *envParser) durationRange(key string, def, min, max time.Duration) time.Duration {
+	d := p.duration(key, def)
+	if d < min || d > max {
+		p.fail(key, d.String(), fmt.Sprintf("must be between %s and %s", min, max))
+		return def
+	}
+
+	return d
+}
+
+// latencies returns the JSON object of data center names to non negative
+// milliseconds in setting key, nil when unset
+func (p *envParser) latencies(key string) map[string]int {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return nil
+	}
+	var m map[string]int
+	if err := json.Unmarshal([]byte(v), &m); err != nil {
+		p.fail(key, v, "is not a JSON object of data centers to milliseconds")
+		return nil
+	}
+	for dc, ms := range m {
+		if ms < 0 {
+			p.fail(key, v, fmt.Sprintf("has a negative latency for %s", dc))
+			return nil
+		}
+	}
+
+	return m
+}
+
+// confirmTargets returns the comma separated exchange:key pairs in setting
+// key, just def when unset
+func (p *envParser) confirmTargets(key string, def confirmTarget) []confirmTarget {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return []confirmTarget{def}
+	}
+	var targets []confirmTarget
+	for _, pair := range splitList(v) {
+		exchange, routingKey, ok := strings.Cut(pair, ":")
+		if !ok || exchange == "" || routingKey == "" {
+			p.fail(key, v, fmt.Sprintf("has %q, not exchange:key", pair))
+			return []confirmTarget{def}
+		}
+		targets = append(targets, confirmTarget{exchange, routingKey})
+	}
+	if len(targets) == 0 {
+		p.fail(key, v, "has no targets")
+		return []confirmTarget{def}
+	}
+
+	return targets
+}
+
+// port returns the TCP port setting key
+func (p *envParser) port(key string, def string) string {
+	v := getEnv(key, def)
+	if n, err := strconv.Atoi(v); err != nil || n < 1 || n > math.MaxUint16 {
+		p.fail(key, v, "is not a port number")
+		return def
+	}
+
+	return v
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigGenerateRate(t *testing.T) {
+	t.Setenv("DISPATCH_GENERATE_RATE", "1e12")
+
+	_, err := loadConfig()
+	if err == nil || !strings.Contains(err.Error(), "DISPATCH_GENERATE_RATE") {
+		t.Errorf("loadConfig error %v, want DISPATCH_GENERATE_RATE out of range", err)
+	}
+
+	t.Setenv("DISPATCH_GENERATE_RATE", "1000")
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.GenerateRate != 1000 {
+		t.Errorf("generate rate %g, want 1000", cfg.GenerateRate)
+	}
+}
+
+func TestEnvParser(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		parse func(p *envParser) any
+		want  any
+		ok    bool
+	}{
+		{"bool", "true", func(p *envParser) any { return p.bool("TEST_SETTING", false) }, true, true},
+		{"bool invalid", "yes please", func(p *envParser) any { return p.bool("TEST_SETTING", false) }, false, false},
+		{"int", "12", func(p *envParser) any { return p.int("TEST_SETTING", 1, 1) }, 12, true},
+		{"int below min", "0", func(p *envParser) any { return p.int("TEST_SETTING", 1, 1) }, 1, false},
+		{"int invalid", "ten", func(p *envParser) any { return p.int("TEST_SETTING", 1, 1) }, 1, false},
+		{"float", "0.25", func(p *envParser) any { return p.float("TEST_SETTING", 1, 0, 1) }, 0.25, true},
+		{"float above max", "1.5", func(p *envParser) any { return p.float("TEST_SETTING", 1, 0, 1) }, 1.0, false},
+		{"float nan", "NaN", func(p *envParser) any { return p.float("TEST_SETTING", 1, 0, 1) }, 1.0, false},
+		{"duration", "250ms", func(p *envParser) any { return p.duration("TEST_SETTING", time.Second) }, 250 * time.Millisecond, true},
+		{"duration negative", "-1s", func(p *envParser) any { return p.duration("TEST_SETTING", time.Second) }, time.Second, false},
+		{"duration invalid", "soon", func(p *envParser) any { return p.duration("TEST_SETTING", time.Second) }, time.Second, false},
+		{"duration range", "2m", func(p *envParser) any {
+			return p.durationRange("TEST_SETTING", time.Second, time.Second, time.Minute)
+		}, time.Second, false},
+		{"port", "8081", func(p *envParser) any { return p.port("TEST_SETTING", "8080") }, "8081", true},
+		{"port invalid", "80808", func(p *envParser) any { return p.port("TEST_SETTING", "8080") }, "8080", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TEST_SETTING", tt.value)
+
+			var p envParser
+			if got := tt.parse(&p); got != tt.want {
+				t.Errorf("parsed %q as %v, want %v", tt.value, got, tt.want)
+			}
+			if ok := len(p.errs) == 0; ok != tt.ok {
+				t.Errorf("errors %v, want ok %t", p.errs, tt.ok)
+			}
+		})
+	}
+}
+
+func TestLoadConfigTelemetry(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		bad  string
+	}{
+		{"defaults", nil, ""},
+		{"log level", map[string]string{"LOG_LEVEL": "debug"}, ""},
+		{"invalid log level", map[string]string{"LOG_LEVEL": "verbose"}, "LOG_LEVEL"},
+		{"logs enabled", map[string]string{"OTEL_LOGS_ENABLED": "true"}, ""},
+		{"invalid logs enabled", map[string]string{"OTEL_LOGS_ENABLED": "maybe"}, "OTEL_LOGS_ENABLED"},
+		{"http protocol", map[string]string{"OTEL_EXPORTER_OTLP_PROTOCOL": "http/protobuf"}, ""},
+		{"invalid protocol", map[string]string{"OTEL_EXPORTER_OTLP_PROTOCOL": "thrift"}, "OTLP protocol"},
+		{"invalid headers", map[string]string{"OTEL_EXPORTER_OTLP_HEADERS": "no-equals-sign"}, "OTLP header"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			cfg, err := loadConfig()
+			if tt.bad != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.bad) {
+					t.Errorf("loadConfig error %v, want one about %s", err, tt.bad)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.OTLP == nil {
+				t.Error("no OTLP settings")
+			}
+		})
+	}
+}
+
+func TestLoadConfigLogSettings(t *testing.T) {
+	t.Setenv("LOG_LEVEL", "warn")
+	t.Setenv("OTEL_LOGS_ENABLED", "true")
+	t.Setenv("OTEL_EXPORTER_OTLP_PROTOCOL", "http/protobuf")
+	t.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "api-key=secret")
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.LogLevel != slog.LevelWarn {
+		t.Errorf("log level %s, want WARN", cfg.LogLevel)
+	}
+	if !cfg.LogsEnabled {
+		t.Error("logs not enabled")
+	}
+	if cfg.OTLP.protocol != "http/protobuf" || cfg.OTLP.headers["api-key"] != "secret" {
+		t.Errorf("OTLP settings %+v", cfg.OTLP)
+	}
+}
+
+func TestLoadConfigQueueType(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		bad  string
+	}{
+		{"classic", map[string]string{"DISPATCH_QUEUE_TYPE": "classic", "DISPATCH_QUEUE_TTL": "1m"}, ""},
+		{"quorum", map[string]string{"DISPATCH_QUEUE_TYPE": "quorum"}, ""},
+		{"unknown", map[string]string{"DISPATCH_QUEUE_TYPE": "stream"}, "DISPATCH_QUEUE_TYPE"},
+		{"quorum with ttl", map[string]string{"DISPATCH_QUEUE_TYPE": "quorum", "DISPATCH_QUEUE_TTL": "1m"}, "DISPATCH_QUEUE_TTL"},
+		{"quorum with priority", map[string]string{"DISPATCH_QUEUE_TYPE": "quorum", "DISPATCH_MAX_PRIORITY": "5"}, "DISPATCH_MAX_PRIORITY"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			_, err := loadConfig()
+			if tt.bad == "" && err != nil {
+				t.Errorf("loadConfig: %v", err)
+			}
+			if tt.bad != "" && (err == nil || !strings.Contains(err.Error(), tt.bad)) {
+				t.Errorf("loadConfig error %v, want one about %s", err, tt.bad)
+			}
+		})
+	}
+}
+
+func TestLoadConfigDeadLetterArgs(t *testing.T) {
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.DeadLetterArgs {
+		t.Error("orders queues declared without a dead letter exchange by default")
+	}
+
+	t.Setenv("DISPATCH_DEAD_LETTER_ARGS", "false")
+	cfg, err = loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DeadLetterArgs {
+		t.Error("DISPATCH_DEAD_LETTER_ARGS=false ignored")
+	}
+}
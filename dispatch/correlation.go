@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand"
+
+	"go.opentelemetry.io/otel/baggage"
+)
+
+// baggage member carrying the business correlation id between services
+const correlationMember = "correlation_id"
+
+// NATS header carrying the correlation id, AMQP has a message property
+const correlationHeader = "Correlation-Id"
+
+// newCorrelationID returns an id for orders that arrive without one
+func newCorrelationID() string {
+	return fmt.Sprintf("%016x%016x", rand.Uint64(), rand.Uint64())
+}
+
+// withCorrelationID returns ctx with id added to its baggage
+func withCorrelationID(ctx context.Context, id string) context.Context {
+	return withBaggageMember(ctx, correlationMember, id)
+}
+
+// withBaggageMember returns ctx with key set to value in its baggage, ctx
+// unchanged when the member is not valid baggage
+func withBaggageMember(ctx context.Context, key, value string) context.Context {
+	member, err := baggage.NewMemberRaw(key, value)
+	if err != nil {
+		slog.WarnContext(ctx, "Invalid baggage member", "key", key, "value", value, "error", err)
+		return ctx
+	}
+	bag, err := baggage.FromContext(ctx).SetMember(member)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to add member to baggage", "key", key, "value", value, "error", err)
+		return ctx
+	}
+
+	return baggage.ContextWithBaggage(ctx, bag)
+}
+
+// correlationID returns the correlation id in the baggage of ctx, if any
+func correlationID(ctx context.Context) string {
+	return baggage.FromContext(ctx).Member(correlationMember).Value()
+}
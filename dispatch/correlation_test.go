@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestCorrelationIDEndToEnd(t *testing.T) {
+	b := &fakeBroker{}
+	useBroker(t, b)
+
+	d := amqpDelivery(amqp.Delivery{
+		Acknowledger:  &fakeAcknowledger{},
+		CorrelationId: "corr-42",
+		Body:          orderBody(uniqueID(t)),
+	}, "")
+	if err := createSpan(context.Background(), d); err != nil {
+		t.Fatal(err)
+	}
+
+	published := b.messages()
+	if len(published) != 1 {
+		t.Fatalf("%d confirmations published, want 1", len(published))
+	}
+	if got := published[0].correlationID; got != "corr-42" {
+		t.Errorf("confirmation correlation id %q, want corr-42", got)
+	}
+}
+
+func TestCorrelationIDGenerated(t *testing.T) {
+	b := &fakeBroker{}
+	useBroker(t, b)
+
+	d := amqpDelivery(amqp.Delivery{Acknowledger: &fakeAcknowledger{}, Body: orderBody(uniqueID(t))}, "")
+	if err := createSpan(context.Background(), d); err != nil {
+		t.Fatal(err)
+	}
+
+	published := b.messages()
+	if len(published) != 1 || published[0].correlationID == "" {
+		t.Errorf("confirmations %+v, want one with a generated correlation id", published)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"math"
+	"strings"
+)
+
+// data center used when the destination is not in the table
+const fallbackDataCenter = "us-east1"
+
+// nearest data center for each country the shipping service delivers to,
+// keyed by the lower case country name
+var countryDataCenters = map[string]string{
+	"australia":      "asia-northeast2",
+	"austria":        "europe-west3",
+	"brasil":         "us-east1",
+	"bulgaria":       "europe-west3",
+	"canada":         "us-west1",
+	"czech republic": "europe-west3",
+	"denmark":        "europe-west3",
+	"finland":        "europe-west3",
+	"france":         "europe-west3",
+	"germany":        "europe-west3",
+	"great britain":  "europe-west3",
+	"hungary":        "europe-west3",
+	"india":          "asia-south1",
+	"italy":          "europe-west3",
+	"japan":          "asia-northeast2",
+	"netherlands":    "europe-west3",
+	"norway":         "europe-west3",
+	"portugal":       "europe-west3",
+	"romania":        "europe-west3",
+	"russia":         "asia-northeast2",
+	"spain":          "europe-west3",
+	"sweden":         "europe-west3",
+	"swiss":          "europe-west3",
+	"turkey":         "asia-south1",
+	"usa":            "us-east1",
+}
+
+// base simulated latency in milliseconds of processing a sale in each data
+// center, replaced by DISPATCH_DATACENTER_LATENCY. Data centers without a
+// profile use DISPATCH_LATENCY_BASE_MS
+var dataCenterLatency = map[string]int{
+	"us-east1":        20,
+	"us-west1":        35,
+	"europe-west3":    60,
+	"asia-northeast2": 120,
+	"asia-south1":     180,
+}
+
+// selectDataCenter picks the data center nearest to where the order is
+// being shipped
+func selectDataCenter(order *Order) string {
+	// destination is the country name followed by the city
+	destination := strings.ToLower(strings.TrimSpace(order.Destination))
+	for country, dc := range countryDataCenters {
+		if destination == country || strings.HasPrefix(destination, country+" ") {
+			return dc
+		}
+	}
+
+	return fallbackDataCenter
+}
+
+// flat handling charge and charge per item for shipping from each data
+// center, made up for the demo
+var dataCenterShippingRates = map[string]struct{ base, perItem float64 }{
+	"us-east1":        {4.99, 0.75},
+	"us-west1":        {5.49, 0.80},
+	"europe-west3":    {6.99, 0.95},
+	"asia-south1":     {7.49, 0.60},
+	"asia-northeast2": {8.99, 1.10},
+}
+
+// estimateShippingCost returns a fake shipping cost for order when shipped
+// from dc, nothing when there are no items to ship
+func estimateShippingCost(order *Order, dc string) float64 {
+	items := order.ItemCount()
+	if items == 0 {
+		return 0
+	}
+
+	rate, ok := dataCenterShippingRates[dc]
+	if !ok {
+		rate = dataCenterShippingRates[fallbackDataCenter]
+	}
+	cost := rate.base + rate.perItem*float64(items)
+
+	// round to cents
+	return math.Round(cost*100) / 100
+}
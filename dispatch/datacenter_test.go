@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestSelectDataCenter(t *testing.T) {
+	tests := []struct {
+		destination string
+		want        string
+	}{
+		{"USA New York", "us-east1"},
+		{"Canada Toronto", "us-west1"},
+		{"Germany Berlin", "europe-west3"},
+		{"great britain london", "europe-west3"},
+		{"Czech Republic Prague", "europe-west3"},
+		{"India Mumbai", "asia-south1"},
+		{"Japan", "asia-northeast2"},
+		{"  Australia Sydney ", "asia-northeast2"},
+		{"Atlantis", fallbackDataCenter},
+		{"Usability Land", fallbackDataCenter},
+		{"", fallbackDataCenter},
+	}
+	for _, tt := range tests {
+		if got := selectDataCenter(&Order{Destination: tt.destination}); got != tt.want {
+			t.Errorf("selectDataCenter(%q) = %s, want %s", tt.destination, got, tt.want)
+		}
+	}
+}
+
+func TestEstimateShippingCost(t *testing.T) {
+	order := func(items ...Item) *Order { return &Order{Items: items} }
+	robot := Item{SKU: "RB1", Qty: 2}
+	shipping := Item{SKU: shippingSKU, Qty: 1}
+
+	tests := []struct {
+		name  string
+		order *Order
+		dc    string
+		want  float64
+	}{
+		{"us-east1", order(robot, shipping), "us-east1", 6.49},
+		{"asia-northeast2", order(robot, shipping), "asia-northeast2", 11.19},
+		{"unknown data center", order(robot), "mars-north1", 6.49},
+		{"shipping only", order(shipping), "us-east1", 0},
+		{"no items", order(), "europe-west3", 0},
+	}
+	for _, tt := range tests {
+		if got := estimateShippingCost(tt.order, tt.dc); got != tt.want {
+			t.Errorf("%s: cost %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
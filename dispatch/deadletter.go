@@ -0,0 +1,182 @@
+package main
+
+import (
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// how long failed orders wait before going back to the orders queue
+const retryDelay = 1 * time.Second
+
+// longest wait of a delayed retry
+const maxRetryDelay = 1 * time.Minute
+
+// header counting the delayed retries of an order, as x-death does for the
+// retry queues
+const retryCountHeader = "x-retry-count"
+
+var (
+	// rejected orders are routed here by the broker
+	deadLetterExchange string
+	deadLetterQueue    string
+
+	// declare the orders queues with the dead letter exchange as an
+	// argument. Turned off for queues declared before without it, which
+	// cannot take new arguments, a policy routes their rejected orders
+	// instead
+	deadLetterArgs bool
+
+	maxRetries int
+
+	// failed orders are republished to delayedExchange, which needs the
+	// RabbitMQ delayed message plugin, instead of the retry queues
+	delayedRetry    bool
+	delayedExchange string
+)
+
+// declareDeadLetter creates the dead letter exchange and queue plus a retry
+// queue for each tenant which expires orders back onto its orders queue
+func declareDeadLetter(ch amqpChannel) error {
+	// dead lettered messages keep their original routing key, so the dead
+	// letter exchange routes them the way the orders exchange did
+	err := ch.ExchangeDeclare(deadLetterExchange, exchangeType, true, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = ch.QueueDeclare(deadLetterQueue, true, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	if delayedRetry {
+		err = ch.ExchangeDeclare(delayedExchange, "x-delayed-message", true, false, false, false, amqp.Table{
+			"x-delayed-type": "direct",
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, tenant := range consumedTenants() {
+		for _, key := range tenantKeys(tenant) {
+			err = ch.QueueBind(deadLetterQueue, key, deadLetterExchange, false, nil)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = ch.QueueDeclare(tenantRetryQueue(tenant), true, false, false, false, amqp.Table{
+			"x-message-ttl":             int64(retryDelay / time.Millisecond),
+			"x-dead-letter-exchange":    exchangeName,
+			"x-dead-letter-routing-key": tenantKeys(tenant)[0],
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deathCount returns how many times the broker has dead lettered the
+// delivery out of queue, as recorded in the x-death header
+func deathCount(headers amqp.Table, queue string) int64 {
+	deaths, ok := headers["x-death"].([]interface{})
+	if !ok {
+		return 0
+	}
+
+	var total int64
+	for _, death := range deaths {
+		var table map[string]interface{}
+		switch t := death.(type) {
+		case amqp.Table:
+			table = t
+		case map[string]interface{}:
+			table = t
+		default:
+			continue
+		}
+		if table["queue"] != queue {
+			continue
+		}
+		switch count := table["count"].(type) {
+		case int64:
+			total += count
+		case int32:
+			total += int64(count)
+		case int:
+			total += int64(count)
+		}
+	}
+
+	return total
+}
+
+// retryCount returns how many times the delivery has been retried
+func retryCount(headers amqp.Table, tenant string) int64 {
+	if !delayedRetry {
+		return deathCount(headers, tenantRetryQueue(tenant))
+	}
+
+	switch count := headers[retryCountHeader].(type) {
+	case int64:
+		return count
+	case int32:
+		return int64(count)
+	case int:
+		return int64(count)
+	}
+
+	return 0
+}
+
+// delayedRetryDelay returns how long an order waits before its retry
+// attempt n (starting at 1), doubling from retryDelay up to maxRetryDelay
+func delayedRetryDelay(attempt int64) time.Duration {
+	d := retryDelay
+	for i := int64(1); i < attempt && d < maxRetryDelay; i++ {
+		d *= 2
+	}
+
+	return min(d, maxRetryDelay)
+}
+
+// retryLater puts a copy of the delivery on the retry queue of tenant, from
+// where it returns to the orders queue once retryDelay has passed. With
+// delayed retries the copy goes to the delayed exchange instead, held back
+// longer after each attempt
+func retryLater(d amqp.Delivery, tenant string) error {
+	if !delayedRetry {
+		return publishMessage("", tenantRetryQueue(tenant), true, retryPublishing(d, d.Headers))
+	}
+
+	attempt := retryCount(d.Headers, tenant) + 1
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers[retryCountHeader] = attempt
+	headers["x-delay"] = delayedRetryDelay(attempt).Milliseconds()
+
+	// the delayed message plugin cannot tell whether a held message will
+	// be routed, so it is not published as mandatory
+	return publishMessage(delayedExchange, tenantQueue(tenant), false, retryPublishing(d, headers))
+}
+
+// retryPublishing copies the delivery for retrying with headers
+func retryPublishing(d amqp.Delivery, headers amqp.Table) amqp.Publishing {
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    amqp.Persistent,
+		MessageId:       d.MessageId,
+		CorrelationId:   d.CorrelationId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		Body:            d.Body,
+	}
+}
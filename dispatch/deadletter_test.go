@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// failedDelivery returns a delivery of the shared queue that has been
+// dead lettered out of its retry queue deaths times
+func failedDelivery(ack amqp.Acknowledger, deaths int64) amqp.Delivery {
+	return amqp.Delivery{
+		Acknowledger: ack,
+		Headers: amqp.Table{
+			"x-death": []interface{}{
+				amqp.Table{"queue": tenantRetryQueue(""), "count": deaths},
+			},
+		},
+		Body: orderBody("abc-1"),
+	}
+}
+
+func TestAcknowledgeAlwaysFailing(t *testing.T) {
+	prevQueue, prevRetries, prevDelayed := queueName, maxRetries, delayedRetry
+	t.Cleanup(func() { queueName, maxRetries, delayedRetry = prevQueue, prevRetries, prevDelayed })
+	queueName, maxRetries, delayedRetry = "orders", 3, false
+
+	err := transient(errors.New("Failed to dispatch to SOP"))
+	ack := &fakeAcknowledger{}
+	for deaths := range int64(maxRetries) {
+		acknowledge(failedDelivery(ack, deaths), "", err)
+		if got := ack.last(); got == "reject" {
+			t.Fatalf("dead lettered after %d retries, want %d", deaths, maxRetries)
+		}
+	}
+
+	acknowledge(failedDelivery(ack, int64(maxRetries)), "", err)
+	if got := ack.last(); got != "reject" {
+		t.Errorf("settled with %q after %d retries, want reject", got, maxRetries)
+	}
+}
+
+func TestQueueArgsDeadLetter(t *testing.T) {
+	prev := deadLetterArgs
+	t.Cleanup(func() { deadLetterArgs = prev })
+
+	deadLetterArgs = false
+	if _, ok := queueArgs()["x-dead-letter-exchange"]; ok {
+		t.Error("dead letter exchange set with DISPATCH_DEAD_LETTER_ARGS off")
+	}
+
+	deadLetterArgs = true
+	if got := queueArgs()["x-dead-letter-exchange"]; got != deadLetterExchange {
+		t.Errorf("x-dead-letter-exchange = %v, want %s", got, deadLetterExchange)
+	}
+}
+
+func TestDeclareDeadLetterExchangeType(t *testing.T) {
+	prevType, prevKeys := exchangeType, routingKeys
+	t.Cleanup(func() { exchangeType, routingKeys = prevType, prevKeys })
+
+	for _, kind := range []string{"direct", "topic", "fanout"} {
+		exchangeType, routingKeys = kind, []string{"orders.*"}
+
+		ch := newFakeChannel()
+		if err := declareDeadLetter(ch); err != nil {
+			t.Fatal(err)
+		}
+		if got := ch.exchanges[deadLetterExchange]; got != kind {
+			t.Errorf("%s: dead letter exchange declared as %s, want %s", kind, got, kind)
+		}
+		if got := ch.boundKeys(deadLetterQueue, deadLetterExchange); !slices.Equal(got, routingKeys) {
+			t.Errorf("%s: dead letter queue bound with %v, want %v", kind, got, routingKeys)
+		}
+	}
+}
+
+func TestDeathCount(t *testing.T) {
+	headers := amqp.Table{
+		"x-death": []interface{}{
+			amqp.Table{"queue": "orders.retry", "reason": "expired", "count": int64(2)},
+			amqp.Table{"queue": "orders", "reason": "rejected", "count": int64(3)},
+			map[string]interface{}{"queue": "orders.retry", "reason": "rejected", "count": int32(1)},
+			"not a table",
+		},
+	}
+
+	tests := []struct {
+		queue string
+		want  int64
+	}{
+		{"orders.retry", 3},
+		{"orders", 3},
+		{"orders.dlq", 0},
+	}
+	for _, tt := range tests {
+		if got := deathCount(headers, tt.queue); got != tt.want {
+			t.Errorf("deathCount(%s) = %d, want %d", tt.queue, got, tt.want)
+		}
+	}
+
+	if got := deathCount(amqp.Table{}, "orders.retry"); got != 0 {
+		t.Errorf("deathCount without x-death = %d, want 0", got)
+	}
+	if got := deathCount(amqp.Table{"x-death": "garbage"}, "orders.retry"); got != 0 {
+		t.Errorf("deathCount with malformed x-death = %d, want 0", got)
+	}
+}
+
+func TestDelayedRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempt int64
+		want    time.Duration
+	}{
+		{1, retryDelay},
+		{2, 2 * retryDelay},
+		{3, 4 * retryDelay},
+		{6, 32 * retryDelay},
+		{7, maxRetryDelay},
+		{100, maxRetryDelay},
+	}
+	for _, tt := range tests {
+		if got := delayedRetryDelay(tt.attempt); got != tt.want {
+			t.Errorf("delayedRetryDelay(%d) = %s, want %s", tt.attempt, got, tt.want)
+		}
+	}
+}
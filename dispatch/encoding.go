@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// content encoding of compressed message bodies
+const gzipEncoding = "gzip"
+
+// published bodies of at least this many bytes are gzipped, 0 never
+var gzipMinBytes int
+
+// encodeBody returns body as it is published and its content encoding,
+// gzipped when it is at least DISPATCH_PUBLISH_GZIP_BYTES long
+func encodeBody(body []byte) ([]byte, string, error) {
+	if gzipMinBytes == 0 || len(body) < gzipMinBytes {
+		return body, "", nil
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(body); err != nil {
+		return nil, "", err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, "", err
+	}
+
+	return buf.Bytes(), gzipEncoding, nil
+}
+
+// decodeBody returns body without its content encoding. Bodies that cannot
+// be decoded fail permanently, so they are dead-lettered for inspection
+// rather than dropped. Decompressed bodies larger than
+// DISPATCH_MAX_BODY_BYTES are oversized like uncompressed ones
+func decodeBody(body []byte, encoding string) ([]byte, error) {
+	switch strings.ToLower(encoding) {
+	case "", "identity":
+		return body, nil
+	case gzipEncoding:
+	default:
+		return nil, permanent(fmt.Errorf("unsupported content encoding %q", encoding))
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, permanent(fmt.Errorf("corrupt gzip body: %w", err))
+	}
+	defer zr.Close()
+
+	// read one byte past the limit to tell a body that is too large
+	var r io.Reader = zr
+	if maxBodyBytes > 0 {
+		r = io.LimitReader(zr, int64(maxBodyBytes)+1)
+	}
+	decoded, err := io.ReadAll(r)
+	if err != nil {
+		return nil, permanent(fmt.Errorf("corrupt gzip body: %w", err))
+	}
+	if maxBodyBytes > 0 && len(decoded) > maxBodyBytes {
+		return nil, fmt.Errorf("%w: decompressed body exceeds %d bytes", errOversized, maxBodyBytes)
+	}
+
+	return decoded, nil
+}
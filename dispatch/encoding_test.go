@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"testing"
+)
+
+func TestEncodeBodyRoundTrip(t *testing.T) {
+	prev := gzipMinBytes
+	t.Cleanup(func() { gzipMinBytes = prev })
+	gzipMinBytes = 64
+
+	small := orderBody("abc-1")[:32]
+	large := bytes.Repeat(orderBody("abc-1"), 20)
+	tests := []struct {
+		name     string
+		body     []byte
+		encoding string
+	}{
+		{"below the threshold", small, ""},
+		{"above the threshold", large, gzipEncoding},
+	}
+	for _, tt := range tests {
+		encoded, encoding, err := encodeBody(tt.body)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if encoding != tt.encoding {
+			t.Errorf("%s: encoded as %q, want %q", tt.name, encoding, tt.encoding)
+		}
+		if encoding == gzipEncoding && len(encoded) >= len(tt.body) {
+			t.Errorf("%s: gzipped to %d bytes from %d", tt.name, len(encoded), len(tt.body))
+		}
+
+		decoded, err := decodeBody(encoded, encoding)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !bytes.Equal(decoded, tt.body) {
+			t.Errorf("%s: round trip changed the body", tt.name)
+		}
+	}
+}
+
+// gzipped returns body gzipped
+func gzipped(t *testing.T, body []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(body); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestDecodeBody(t *testing.T) {
+	prev := maxBodyBytes
+	t.Cleanup(func() { maxBodyBytes = prev })
+	maxBodyBytes = 1024
+
+	body := orderBody("abc-1")
+	zipped := gzipped(t, body)
+	tests := []struct {
+		name     string
+		body     []byte
+		encoding string
+	}{
+		{"plain", body, ""},
+		{"identity", body, "identity"},
+		{"gzipped", zipped, "gzip"},
+		{"gzipped upper case", zipped, "GZIP"},
+	}
+	for _, tt := range tests {
+		got, err := decodeBody(tt.body, tt.encoding)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !bytes.Equal(got, body) {
+			t.Errorf("%s: decoded %q, want %q", tt.name, got, body)
+		}
+	}
+}
+
+func TestDecodeBodyInvalid(t *testing.T) {
+	prev := maxBodyBytes
+	t.Cleanup(func() { maxBodyBytes = prev })
+	maxBodyBytes = 1024
+
+	zipped := gzipped(t, orderBody("abc-1"))
+	tests := []struct {
+		name     string
+		body     []byte
+		encoding string
+		want     error
+	}{
+		{"not gzip", orderBody("abc-1"), "gzip", errPermanent},
+		{"truncated", zipped[:len(zipped)/2], "gzip", errPermanent},
+		{"unsupported", orderBody("abc-1"), "br", errPermanent},
+		{"oversized once decompressed", gzipped(t, bytes.Repeat([]byte(" "), 2048)), "gzip", errOversized},
+	}
+	for _, tt := range tests {
+		if _, err := decodeBody(tt.body, tt.encoding); !errors.Is(err, tt.want) {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
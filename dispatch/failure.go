@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// classes of failure deciding what happens to an order that failed. Errors
+// without a class are treated as transient, invalid orders are marked with
+// errInvalidOrder
+var (
+	// worth trying again later, until maxRetries is reached
+	errTransient = errors.New("transient failure")
+
+	// will fail however often it is tried, dead lettered straight away
+	errPermanent = errors.New("permanent failure")
+)
+
+// classifiedError is an error marked with a class of failure, keeping its
+// own message
+type classifiedError struct {
+	error
+	class error
+}
+
+func (e classifiedError) Is(target error) bool {
+	return target == e.class
+}
+
+func (e classifiedError) Unwrap() error {
+	return e.error
+}
+
+// transient marks err as worth retrying
+func transient(err error) error {
+	return classifiedError{err, errTransient}
+}
+
+// permanent marks err as never going to succeed
+func permanent(err error) error {
+	return classifiedError{err, errPermanent}
+}
+
+// disposition is what is done with a delivery once it has been processed
+type disposition int
+
+const (
+	// acknowledged as done
+	dispositionAck disposition = iota
+
+	// acknowledged without being processed, it can never be
+	dispositionDrop
+
+	// handed straight back to the broker for redelivery
+	dispositionRequeue
+
+	// redelivered after a delay, dead lettered once out of retries
+	dispositionRetry
+
+	// sent to the dead letter queue
+	dispositionDeadLetter
+)
+
+func (d disposition) String() string {
+	switch d {
+	case dispositionAck:
+		return "ack"
+	case dispositionDrop:
+		return "drop"
+	case dispositionRequeue:
+		return "requeue"
+	case dispositionRetry:
+		return "retry"
+	case dispositionDeadLetter:
+		return "dead_letter"
+	}
+	return "unknown"
+}
+
+// classify returns the disposition of a delivery that was processed with
+// err, the same whichever broker it came from
+func classify(err error) disposition {
+	switch {
+	case err == nil:
+		return dispositionAck
+	case errors.Is(err, errInvalidOrder):
+		return dispositionDrop
+	case errors.Is(err, errPermanent):
+		return dispositionDeadLetter
+	case errors.Is(err, errCircuitOpen):
+		return dispositionRequeue
+	case errors.Is(err, context.Canceled):
+		// processing was interrupted by shutting down, not by the order
+		return dispositionRequeue
+	default:
+		return dispositionRetry
+	}
+}
+
+// finalFailure reports whether an order that failed with err, after being
+// delivered redeliveries times before, is given up on rather than tried
+// again
+func finalFailure(err error, redeliveries int64) bool {
+	switch classify(err) {
+	case dispositionDeadLetter:
+		return true
+	case dispositionRetry:
+		return redeliveries >= int64(maxRetries)
+	}
+	return false
+}
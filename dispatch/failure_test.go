@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/propagation"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want disposition
+	}{
+		{"success", nil, dispositionAck},
+		{"invalid order", fmt.Errorf("%w: no order id", errInvalidOrder), dispositionDrop},
+		{"permanent", permanent(errors.New("order does not match the schema")), dispositionDeadLetter},
+		{"wrapped permanent", fmt.Errorf("processing: %w", permanent(errors.New("panic"))), dispositionDeadLetter},
+		{"circuit open", fmt.Errorf("dispatching: %w", errCircuitOpen), dispositionRequeue},
+		{"transient", transient(errors.New("Failed to dispatch to SOP")), dispositionRetry},
+		{"cancelled", fmt.Errorf("processing sale cancelled: %w", context.Canceled), dispositionRequeue},
+		{"deadline", context.DeadlineExceeded, dispositionRetry},
+		{"unclassified", errors.New("something went wrong"), dispositionRetry},
+	}
+	for _, tt := range tests {
+		if got := classify(tt.err); got != tt.want {
+			t.Errorf("%s: classified %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFinalFailure(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		redeliveries int64
+		want         bool
+	}{
+		{"invalid order", fmt.Errorf("%w: no order id", errInvalidOrder), 0, false},
+		{"permanent", permanent(errors.New("panic")), 0, true},
+		{"circuit open", errCircuitOpen, int64(maxRetries), false},
+		{"retried", transient(errors.New("Failed to dispatch to SOP")), int64(maxRetries) - 1, false},
+		{"out of retries", transient(errors.New("Failed to dispatch to SOP")), int64(maxRetries), true},
+	}
+	for _, tt := range tests {
+		if got := finalFailure(tt.err, tt.redeliveries); got != tt.want {
+			t.Errorf("%s: final failure %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestClassifiedErrorKeepsMessage(t *testing.T) {
+	cause := errors.New("SOP unavailable")
+	err := transient(cause)
+
+	if err.Error() != cause.Error() {
+		t.Errorf("message %q, want %q", err.Error(), cause.Error())
+	}
+	if !errors.Is(err, cause) || !errors.Is(err, errTransient) || errors.Is(err, errPermanent) {
+		t.Errorf("transient error matches cause %t, transient %t, permanent %t, want true, true, false",
+			errors.Is(err, cause), errors.Is(err, errTransient), errors.Is(err, errPermanent))
+	}
+}
+
+func TestCreateSpanCancelledMidSleep(t *testing.T) {
+	prevBase, prevLatency := latencyBase, dataCenterLatency
+	t.Cleanup(func() { latencyBase, dataCenterLatency = prevBase, prevLatency })
+	latencyBase, dataCenterLatency = 10000, nil
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	err := createSpan(ctx, Delivery{Headers: propagation.MapCarrier{}, Body: orderBody(uniqueID(t))})
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("cancelled order took %s, want the sleep cut short", elapsed)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled order failed with %v, want %v", err, context.Canceled)
+	}
+	if got := classify(err); got != dispositionRequeue {
+		t.Errorf("cancelled order classified %s, want requeue", got)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// products and destinations the synthetic orders are made from
+var (
+	generatedProducts = []Item{
+		{SKU: "Watson", Name: "Watson", Price: 2001},
+		{SKU: "Ewooid", Name: "Ewooid", Price: 200},
+		{SKU: "HPTD", Name: "High-Powered Travel Droid", Price: 1200},
+		{SKU: "UHJ", Name: "Ultimate Harvesting Juggernaut", Price: 5000},
+		{SKU: "EPE", Name: "Extreme Probe Emulator", Price: 953},
+		{SKU: "EMM", Name: "Exceptional Medical Machine", Price: 1024},
+		{SKU: "SHCE", Name: "Strategic Human Control Emulator", Price: 300},
+		{SKU: "RED", Name: "Responsive Enforcer Droid", Price: 700},
+	}
+	generatedDestinations = []string{
+		"Australia", "Canada", "France", "Germany", "Great Britain",
+		"India", "Japan", "United States",
+	}
+)
+
+// highest DISPATCH_GENERATE_RATE, faster tickers than a microsecond cannot
+// keep up anyway
+const maxGenerateRate = 1e6
+
+// generateOrders publishes rate synthetic orders a second to the orders
+// exchange until ctx is done, each starting a trace of its own
+func generateOrders(ctx context.Context, rate float64) {
+	tracer := otel.Tracer("dispatch-service")
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := generateOrder(ctx, tracer); err != nil {
+			slog.WarnContext(ctx, "Failed to publish generated order", "error", err)
+		}
+	}
+}
+
+// generateOrder publishes a single synthetic order in a producer span
+func generateOrder(ctx context.Context, tracer trace.Tracer) error {
+	ctx, span := tracer.Start(ctx, "generateOrder", trace.WithSpanKind(trace.SpanKindProducer))
+	defer span.End()
+
+	tenant := consumedTenants()[rand.Intn(len(consumedTenants()))]
+	keys := tenantKeys(tenant)
+	key := keys[rand.Intn(len(keys))]
+	orderID := fmt.Sprintf("%016x", rand.Uint64())
+	span.SetAttributes(
+		attribute.String("messaging.system", broker.System()),
+		attribute.String("messaging.destination.name", exchangeName),
+		attribute.String("messaging.rabbitmq.routing_key", key),
+		attribute.String("orderid", orderID),
+	)
+
+	body, err := json.Marshal(syntheticOrder(orderID))
+	if err == nil {
+		err = broker.Publish(ctx, exchangeName, key, body)
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	return err
+}
+
+// syntheticOrder returns a random order in the format the payment service
+// publishes
+func syntheticOrder(id string) orderMessage {
+	msg := orderMessage{
+		OrderID: orderID(id),
+		User:    fmt.Sprintf("anonymous-%d", rand.Intn(1000000)),
+	}
+	msg.Cart = &orderCart{}
+
+	for i := 0; i < 1+rand.Intn(3); i++ {
+		item := generatedProducts[rand.Intn(len(generatedProducts))]
+		item.Qty = 1 + rand.Intn(2)
+		item.Subtotal = item.Price * float64(item.Qty)
+		msg.Cart.Items = append(msg.Cart.Items, item)
+		msg.Cart.Total += item.Subtotal
+	}
+
+	destination := generatedDestinations[rand.Intn(len(generatedDestinations))]
+	msg.Cart.Items = append(msg.Cart.Items, Item{
+		SKU:      shippingSKU,
+		Name:     shippingPrefix + destination,
+		Qty:      1,
+		Price:    10,
+		Subtotal: 10,
+	})
+	msg.Cart.Total += 10
+
+	return msg
+}
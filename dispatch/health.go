@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// connected is true while orders are being consumed from RabbitMQ
+var connected atomic.Bool
+
+// everConnected is set once orders have first been consumed
+var everConnected atomic.Bool
+
+func setConnected(c bool) {
+	if c {
+		everConnected.Store(true)
+	}
+	if connected.Swap(c) != c {
+		slog.Info("RabbitMQ connection state changed", "connected", c)
+	}
+}
+
+func isConnected() bool {
+	return connected.Load()
+}
+
+// exitIfNeverConnected exits once timeout has passed if orders have not been
+// consumed yet, so the orchestrator sees a crash loop rather than a pod that
+// never becomes ready
+func exitIfNeverConnected(timeout time.Duration) {
+	time.AfterFunc(timeout, func() {
+		if !everConnected.Load() {
+			fatal("Not connected to broker within startup timeout", "timeout", timeout.String())
+		}
+	})
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "OK")
+}
+
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	if !isConnected() {
+		http.Error(w, "not connected to RabbitMQ", http.StatusServiceUnavailable)
+		return
+	}
+	if selfTest && !selfTestPassed.Load() {
+		http.Error(w, "self test not passed", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "OK")
+}
+
+// errorPercentHandler returns the simulated SOP error percentage on GET and
+// sets it from a plain text body between 0 and 100 on POST
+func errorPercentHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		body, err := io.ReadAll(io.LimitReader(r.Body, 16))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pct, err := strconv.Atoi(strings.TrimSpace(string(body)))
+		if err != nil || pct < 0 || pct > 100 {
+			http.Error(w, "error percent must be a number from 0 to 100", http.StatusBadRequest)
+			return
+		}
+		if old := errorPercent.Swap(int32(pct)); old != int32(pct) {
+			slog.Info("Error percent changed", "from", old, "to", pct)
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fmt.Fprintln(w, errorPercent.Load())
+}
+
+// effectiveConfig is the configuration the service is running with, leaving
+// out secrets
+type effectiveConfig struct {
+	Broker          string   `json:"broker"`
+	AMQPURI         string   `json:"amqp_uri"`
+	Exchange        string   `json:"exchange"`
+	ExchangeType    string   `json:"exchange_type"`
+	Queue           string   `json:"queue"`
+	QueueType       string   `json:"queue_type"`
+	RoutingKeys     []string `json:"routing_keys"`
+	Tenants         []string `json:"tenants"`
+	ConsumerTag     string   `json:"consumer_tag"`
+	ManualAck       bool     `json:"manual_ack"`
+	DryRun          bool     `json:"dry_run"`
+	Prefetch        int      `json:"prefetch"`
+	MaxConcurrency  int      `json:"max_concurrency"`
+	Consumers       int      `json:"consumers"`
+	MaxRetries      int      `json:"max_retries"`
+	ErrorPercent    int32    `json:"error_percent"`
+	SamplingRatio   float64  `json:"sampling_ratio"`
+	LatencyBaseMs   int      `json:"latency_base_ms"`
+	LatencyJitterMs int      `json:"latency_jitter_ms"`
+	OrderTimeout    string   `json:"order_timeout"`
+	ShutdownTimeout string   `json:"shutdown_timeout"`
+}
+
+// configHandler returns the effective configuration as JSON, with the
+// password in the broker URI redacted
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cfg := effectiveConfig{
+		Broker:          broker.System(),
+		AMQPURI:         redactURI(amqpUri),
+		Exchange:        exchangeName,
+		ExchangeType:    exchangeType,
+		Queue:           queueName,
+		QueueType:       queueType,
+		RoutingKeys:     routingKeys,
+		Tenants:         tenants,
+		ConsumerTag:     consumerTag,
+		ManualAck:       manualAck,
+		DryRun:          dryRun,
+		Prefetch:        prefetch,
+		MaxConcurrency:  maxConcurrency,
+		Consumers:       consumers,
+		MaxRetries:      maxRetries,
+		ErrorPercent:    errorPercent.Load(),
+		SamplingRatio:   sampleRatio,
+		LatencyBaseMs:   latencyBase,
+		LatencyJitterMs: latencyJitter,
+		OrderTimeout:    orderTimeout.String(),
+		ShutdownTimeout: shutdownTimeout.String(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(cfg); err != nil {
+		slog.Error("Failed to write config", "error", err)
+	}
+}
+
+// startHealthServer serves the liveness and readiness probes, the Prometheus
+// metrics and the runtime configuration on port, plus the pprof handlers
+// when enableProfiling is set
+func startHealthServer(port string, enableProfiling bool) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthHandler)
+	mux.HandleFunc("/readyz", readyHandler)
+	// OpenMetrics is needed to expose exemplars
+	mux.Handle("/metrics", promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})))
+	mux.HandleFunc("/config", configHandler)
+	mux.HandleFunc("/config/error-percent", adminOnly(errorPercentHandler))
+	mux.HandleFunc("/admin/pause", adminOnly(pauseHandler))
+	mux.HandleFunc("/admin/resume", adminOnly(resumeHandler))
+	mux.HandleFunc("/admin/state", adminOnly(stateHandler))
+
+	if enableProfiling {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		slog.Warn("Profiling endpoints enabled on /debug/pprof/")
+	}
+
+	server := &http.Server{
+		Addr:    ":" + port,
+		Handler: mux,
+	}
+
+	go func() {
+		slog.Info("Health server listening", "addr", server.Addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fatal("Health server failed", "error", err)
+		}
+	}()
+
+	return server
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestErrorPercentAdminOnly(t *testing.T) {
+	prevToken, prevPct := adminToken, errorPercent.Load()
+	t.Cleanup(func() {
+		adminToken = prevToken
+		errorPercent.Store(prevPct)
+	})
+	adminToken = "s3cret"
+	errorPercent.Store(0)
+
+	server := startHealthServer("0", false)
+	t.Cleanup(func() { server.Close() })
+
+	set := func(auth string) int {
+		req := httptest.NewRequest(http.MethodPost, "/config/error-percent", strings.NewReader("50"))
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		server.Handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for _, auth := range []string{"", "Bearer wrong"} {
+		if code := set(auth); code != http.StatusUnauthorized {
+			t.Errorf("setting the error percent with %q got %d, want %d", auth, code, http.StatusUnauthorized)
+		}
+	}
+	if pct := errorPercent.Load(); pct != 0 {
+		t.Fatalf("unauthorized request set the error percent to %d", pct)
+	}
+
+	if code := set("Bearer s3cret"); code != http.StatusOK {
+		t.Errorf("setting the error percent with the token got %d, want %d", code, http.StatusOK)
+	}
+	if pct := errorPercent.Load(); pct != 50 {
+		t.Errorf("error percent %d, want 50", pct)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// seenOrders remembers the orders already dispatched so redelivered
+// duplicates are skipped
+var seenOrders seenSet
+
+// recentMessages holds the ids of the messages processed most recently, nil
+// when DISPATCH_MESSAGE_ID_CACHE is 0
+var recentMessages *lruSet
+
+// seenSet is a set of order ids whose members expire after a TTL
+type seenSet interface {
+	Contains(ctx context.Context, orderID string) (bool, error)
+	Add(ctx context.Context, orderID string) error
+}
+
+// memorySeenSet is a seenSet local to this process
+type memorySeenSet struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	expires map[string]time.Time
+	pruned  time.Time
+}
+
+func newMemorySeenSet(ttl time.Duration) *memorySeenSet {
+	return &memorySeenSet{
+		ttl:     ttl,
+		expires: make(map[string]time.Time),
+		pruned:  time.Now(),
+	}
+}
+
+func (s *memorySeenSet) Contains(ctx context.Context, orderID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expires, ok := s.expires[orderID]
+	return ok && time.Now().Before(expires), nil
+}
+
+func (s *memorySeenSet) Add(ctx context.Context, orderID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.expires[orderID] = now.Add(s.ttl)
+
+	// drop expired ids at most once per TTL
+	if now.Sub(s.pruned) >= s.ttl {
+		for id, expires := range s.expires {
+			if !now.Before(expires) {
+				delete(s.expires, id)
+			}
+		}
+		s.pruned = now
+	}
+
+	return nil
+}
+
+// redisSeenSet is a seenSet shared by all dispatch instances
+type redisSeenSet struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+func newRedisSeenSet(addr string, ttl time.Duration) *redisSeenSet {
+	return &redisSeenSet{
+		client: redis.NewClient(&redis.Options{Addr: addr}),
+		ttl:    ttl,
+	}
+}
+
+func (s *redisSeenSet) key(orderID string) string {
+	return Service + ":seen:" + orderID
+}
+
+func (s *redisSeenSet) Contains(ctx context.Context, orderID string) (bool, error) {
+	n, err := s.client.Exists(ctx, s.key(orderID)).Result()
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
+
+func (s *redisSeenSet) Add(ctx context.Context, orderID string) error {
+	return s.client.Set(ctx, s.key(orderID), 1, s.ttl).Err()
+}
+
+// lruSet is a set holding at most size members, evicting the least recently
+// used when full
+type lruSet struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	members map[string]*list.Element
+}
+
+func newLRUSet(size int) *lruSet {
+	return &lruSet{
+		size:    size,
+		order:   list.New(),
+		members: make(map[string]*list.Element),
+	}
+}
+
+// Contains reports whether key is in the set, counting as a use of it
+func (s *lruSet) Contains(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.members[key]
+	if ok {
+		s.order.MoveToFront(e)
+	}
+
+	return ok
+}
+
+func (s *lruSet) Add(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.members[key]; ok {
+		s.order.MoveToFront(e)
+		return
+	}
+
+	s.members[key] = s.order.PushFront(key)
+	if s.order.Len() > s.size {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.members, oldest.Value.(string))
+	}
+}
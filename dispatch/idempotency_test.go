@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel/propagation"
+)
+
+func TestCreateSpanSkipsDuplicateOrder(t *testing.T) {
+	b := &fakeBroker{}
+	useBroker(t, b)
+	spans := recordSpans(t)
+
+	body := orderBody(uniqueID(t))
+	for range 2 {
+		if err := createSpan(context.Background(), Delivery{Headers: propagation.MapCarrier{}, Body: body}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := len(b.messages()); n != 1 {
+		t.Errorf("%d confirmations published, want 1", n)
+	}
+
+	var duplicates int
+	for _, span := range spans.GetSpans() {
+		for _, event := range span.Events {
+			if event.Name == "duplicate_order" {
+				duplicates++
+			}
+		}
+	}
+	if duplicates != 1 {
+		t.Errorf("%d duplicate_order events, want 1", duplicates)
+	}
+}
+
+func TestLRUSetEviction(t *testing.T) {
+	s := newLRUSet(2)
+	s.Add("a")
+	s.Add("b")
+
+	// using a makes b the least recently used
+	if !s.Contains("a") {
+		t.Fatal("a missing")
+	}
+	s.Add("c")
+
+	if s.Contains("b") {
+		t.Error("b kept, want it evicted as least recently used")
+	}
+	if !s.Contains("a") || !s.Contains("c") {
+		t.Error("a or c evicted")
+	}
+
+	// adding a member again does not grow the set
+	s.Add("c")
+	s.Add("d")
+	if s.Contains("a") {
+		t.Error("a kept, want it evicted")
+	}
+	if !s.Contains("c") || !s.Contains("d") {
+		t.Error("c or d evicted")
+	}
+}
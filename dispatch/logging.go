@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"go.opentelemetry.io/contrib/bridges/otelslog"
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploggrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploghttp"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/credentials"
+)
+
+// only one in every logSampleN orders has its per order info logs written,
+// errors and warnings are always written
+var (
+	logSampleN   int64 = 1
+	orderLogSeen atomic.Int64
+)
+
+// orderLogsKey is the context key of whether the info logs of an order are
+// written
+type orderLogsKey struct{}
+
+// sampleOrderLogs decides whether the info logs of the next order are
+// written, so each order is logged in full or not at all
+func sampleOrderLogs() bool {
+	return logSampleN <= 1 || (orderLogSeen.Add(1)-1)%logSampleN == 0
+}
+
+// withOrderLogs returns ctx carrying whether the info logs of its order are
+// written
+func withOrderLogs(ctx context.Context, logged bool) context.Context {
+	return context.WithValue(ctx, orderLogsKey{}, logged)
+}
+
+// logOrder writes a per order info log unless the order was sampled out
+func logOrder(ctx context.Context, msg string, args ...any) {
+	if logged, ok := ctx.Value(orderLogsKey{}).(bool); ok && !logged {
+		return
+	}
+
+	slog.InfoContext(ctx, msg, args...)
+}
+
+// traceIDs returns the trace and span ids of the span active in ctx, ok is
+// false when there is none
+func traceIDs(ctx context.Context) (traceID string, spanID string, ok bool) {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return "", "", false
+	}
+
+	return sc.TraceID().String(), sc.SpanID().String(), true
+}
+
+// traceHandler adds the ids of the active span to each record so log lines
+// can be matched to their trace
+type traceHandler struct {
+	slog.Handler
+}
+
+func (h traceHandler) Handle(ctx context.Context, r slog.Record) error {
+	if traceID, spanID, ok := traceIDs(ctx); ok {
+		r.AddAttrs(
+			slog.String("trace_id", traceID),
+			slog.String("span_id", spanID),
+		)
+	}
+
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h traceHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return traceHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h traceHandler) WithGroup(name string) slog.Handler {
+	return traceHandler{h.Handler.WithGroup(name)}
+}
+
+// teeHandler writes each record locally and exports it to the collector,
+// both filtered by the level of the local handler
+type teeHandler struct {
+	local  slog.Handler
+	export slog.Handler
+}
+
+func (h teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.local.Enabled(ctx, level)
+}
+
+func (h teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	return errors.Join(h.local.Handle(ctx, r.Clone()), h.export.Handle(ctx, r))
+}
+
+func (h teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return teeHandler{h.local.WithAttrs(attrs), h.export.WithAttrs(attrs)}
+}
+
+func (h teeHandler) WithGroup(name string) slog.Handler {
+	return teeHandler{h.local.WithGroup(name), h.export.WithGroup(name)}
+}
+
+// level logged at, info until LOG_LEVEL has been read with the rest of the
+// configuration
+var logLevel = new(slog.LevelVar)
+
+// initLogger sets the default logger from LOG_FORMAT, writing JSON unless the
+// format is text
+func initLogger() {
+	opts := &slog.HandlerOptions{Level: logLevel}
+
+	var handler slog.Handler
+	if strings.EqualFold(os.Getenv("LOG_FORMAT"), "text") {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	}
+
+	slog.SetDefault(slog.New(traceHandler{handler}))
+}
+
+func newLogExporter(ctx context.Context, cfg *otlpConfig) (sdklog.Exporter, error) {
+	if cfg.protocol == "http/protobuf" {
+		var opts []otlploghttp.Option
+		if cfg.endpoint != "" {
+			opts = append(opts, otlploghttp.WithEndpointURL(signalURL(cfg.endpoint, "/v1/logs")))
+		}
+		if len(cfg.headers) > 0 {
+			opts = append(opts, otlploghttp.WithHeaders(cfg.headers))
+		}
+		if cfg.tls != nil {
+			opts = append(opts, otlploghttp.WithTLSClientConfig(cfg.tls))
+		} else if cfg.insecure() {
+			opts = append(opts, otlploghttp.WithInsecure())
+		}
+		return otlploghttp.New(ctx, opts...)
+	}
+
+	var opts []otlploggrpc.Option
+	if cfg.endpoint != "" {
+		opts = append(opts, otlploggrpc.WithEndpointURL(cfg.endpoint))
+	}
+	if len(cfg.headers) > 0 {
+		opts = append(opts, otlploggrpc.WithHeaders(cfg.headers))
+	}
+	if cfg.tls != nil {
+		opts = append(opts, otlploggrpc.WithTLSCredentials(credentials.NewTLS(cfg.tls)))
+	} else if cfg.insecure() {
+		opts = append(opts, otlploggrpc.WithInsecure())
+	}
+	return otlploggrpc.New(ctx, opts...)
+}
+
+// initLogExport also exports log records to the collector, for when
+// OTEL_LOGS_ENABLED is set. The bridge takes the trace and span ids from the
+// context of each record
+func initLogExport(otlp *otlpConfig) *sdklog.LoggerProvider {
+	exporter, err := newLogExporter(context.Background(), otlp)
+	if err != nil {
+		fatal("Failed to create log exporter", "error", err)
+	}
+
+	lp := sdklog.NewLoggerProvider(
+		sdklog.WithProcessor(sdklog.NewBatchProcessor(exporter)),
+		sdklog.WithResource(serviceResource()),
+	)
+
+	export := otelslog.NewHandler("dispatch-service", otelslog.WithLoggerProvider(lp))
+	slog.SetDefault(slog.New(teeHandler{slog.Default().Handler(), export}))
+	slog.Info("Exporting logs to the collector")
+
+	return lp
+}
+
+// fatal logs msg at error level and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
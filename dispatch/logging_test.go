@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// loggedRecord is a log record kept by a recordingHandler
+type loggedRecord struct {
+	msg     string
+	orderID string
+	traceID trace.TraceID
+}
+
+// recordingHandler keeps the message, order id and trace of each record
+type recordingHandler struct {
+	mu      sync.Mutex
+	records []loggedRecord
+}
+
+func (h *recordingHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (h *recordingHandler) Handle(ctx context.Context, r slog.Record) error {
+	rec := loggedRecord{msg: r.Message, traceID: trace.SpanContextFromContext(ctx).TraceID()}
+	r.Attrs(func(attr slog.Attr) bool {
+		if attr.Key == "orderid" {
+			rec.orderID = attr.Value.String()
+		}
+		return true
+	})
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, rec)
+
+	return nil
+}
+
+func (h *recordingHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *recordingHandler) WithGroup(string) slog.Handler      { return h }
+
+// recordLogs keeps the logs written for the rest of the test
+func recordLogs(t *testing.T) *recordingHandler {
+	t.Helper()
+	h := &recordingHandler{}
+	prev := slog.Default()
+	slog.SetDefault(slog.New(h))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+
+	return h
+}
+
+func TestLogOrderSamplesWholeOrders(t *testing.T) {
+	recordSpans(t)
+	logs := recordLogs(t)
+	prev := logSampleN
+	t.Cleanup(func() { logSampleN = prev })
+	logSampleN = 2
+
+	const orders = 6
+	msgs := make(chan Delivery)
+	var settled sync.WaitGroup
+	go func() {
+		for range orders {
+			settled.Add(1)
+			msgs <- Delivery{
+				Headers: propagation.MapCarrier{},
+				Body:    orderBody(uniqueID(t)),
+				settle:  func(error) { settled.Done() },
+			}
+		}
+		close(msgs)
+	}()
+	consumeOrders(context.Background(), context.Background(), msgs, make(chan struct{}, 2))
+	settled.Wait()
+
+	received := map[string]bool{}
+	processing := map[trace.TraceID]string{}
+	var sent []trace.TraceID
+	for _, rec := range logs.records {
+		switch rec.msg {
+		case "Order received":
+			received[rec.orderID] = true
+		case "Processing order":
+			processing[rec.traceID] = rec.orderID
+		case "Order sent for processing":
+			sent = append(sent, rec.traceID)
+		}
+	}
+
+	if len(received) != orders/2 {
+		t.Errorf("%d of %d orders logged as received, want %d", len(received), orders, orders/2)
+	}
+	if len(processing) != len(received) || len(sent) != len(received) {
+		t.Errorf("%d orders logged as received, %d as processing and %d as sent, want the same orders throughout",
+			len(received), len(processing), len(sent))
+	}
+	for _, orderID := range processing {
+		if !received[orderID] {
+			t.Errorf("order %s logged as processing but not as received", orderID)
+		}
+	}
+	for _, traceID := range sent {
+		if _, ok := processing[traceID]; !ok {
+			t.Errorf("trace %s logged as sent but not as processing", traceID)
+		}
+	}
+}
@@ -2,18 +2,30 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"math/rand"
+	"net"
+	"net/url"
 	"os"
-	"strconv"
+	"os/signal"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 	"context"
+	"crypto/tls"
 
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
 	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
 	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
@@ -21,47 +33,152 @@ import (
 	"go.opentelemetry.io/otel/trace"
 
 	"github.com/streadway/amqp"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc/credentials"
 )
 
 const (
 	Service = "dispatch"
 )
 
+// how long orders cancelled at the shutdown timeout get to settle
+const abortTimeout = 5 * time.Second
+
+// longest message body written to the logs
+const maxLoggedBody = 256
+
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
 var (
 	amqpUri          string
-	rabbitChan       *amqp.Channel
+	amqpTLS          *tls.Config
+	amqpHeartbeat    time.Duration
+	amqpDialTimeout  time.Duration
+	exchangeName     string
+	exchangeType     string
+	queueName        string
+	consumerTag      string
+	routingKeys      []string
+	rabbitConn       amqpConnection
+	rabbitChan       amqpChannel
 	rabbitCloseError chan *amqp.Error
-	rabbitReady      chan bool
-	errorPercent     int
+	rabbitReady      chan amqpChannel
+	errorPercent     atomic.Int32
+	failPattern      *regexp.Regexp
+	manualAck        bool
+	maxConcurrency   int
+	consumers        int
+	prefetch         int
+	shutdownTimeout  time.Duration
+	orderTimeout     time.Duration
+	latencyBase      int
+	latencyJitter    int
+	reconnectBase    time.Duration
+	reconnectMax     time.Duration
+	maxReconnects    int
+	logBodies        bool
+	queueType        string
+	queueTTL         time.Duration
+	queueMaxLength   int
+	queueMaxPriority int
+	sampleRatio      float64
+	dryRun           bool
+	maxBodyBytes     int
 
-	dataCenters = []string{
-		"asia-northeast2",
-		"asia-south1",
-		"europe-west3",
-		"us-east1",
-		"us-west1",
-	}
+	// caps the orders processed each second
+	orderLimiter = rate.NewLimiter(rate.Inf, 1)
+
+	// guards the simulated SOP dispatch
+	sopBreaker *circuitBreaker
+
+	// orders currently being processed
+	inflight sync.WaitGroup
+
+	// extra resource attributes from OTEL_RESOURCE_ATTRIBUTES
+	resourceAttrs []attribute.KeyValue
+
+	// guards rabbitConn, which rabbitConnector replaces on reconnect.
+	// rabbitChan is only used by rabbitConnector, which hands the consumer
+	// channel over through rabbitReady
+	rabbitConnMu sync.Mutex
 )
 
-func initTracer() *sdktrace.TracerProvider {
+// serviceResource describes this service to the trace and metric providers.
+// Attributes from OTEL_RESOURCE_ATTRIBUTES are included, though the ones
+// set here take precedence
+func serviceResource() *resource.Resource {
+	// the pod name under Kubernetes, showing which replica did the work
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	attrs := append([]attribute.KeyValue{}, resourceAttrs...)
+	attrs = append(attrs,
+		semconv.ServiceNameKey.String("dispatch"),
+		semconv.ServiceVersionKey.String(getEnv("SERVICE_VERSION", version)),
+		semconv.DeploymentEnvironmentKey.String(getEnv("DEPLOY_ENV", "unknown")),
+		semconv.HostNameKey.String(hostname),
+	)
+
+	return resource.NewWithAttributes(semconv.SchemaURL, attrs...)
+}
+
+func newTraceExporter(ctx context.Context, cfg *otlpConfig) (sdktrace.SpanExporter, error) {
+	if cfg.protocol == "http/protobuf" {
+		var opts []otlptracehttp.Option
+		if cfg.endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(signalURL(cfg.endpoint, "/v1/traces")))
+		}
+		if len(cfg.headers) > 0 {
+			opts = append(opts, otlptracehttp.WithHeaders(cfg.headers))
+		}
+		if cfg.tls != nil {
+			opts = append(opts, otlptracehttp.WithTLSClientConfig(cfg.tls))
+		} else if cfg.insecure() {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(ctx, opts...)
+	}
+
+	var opts []otlptracegrpc.Option
+	if cfg.endpoint != "" {
+		opts = append(opts, otlptracegrpc.WithEndpointURL(cfg.endpoint))
+	}
+	if len(cfg.headers) > 0 {
+		opts = append(opts, otlptracegrpc.WithHeaders(cfg.headers))
+	}
+	if cfg.tls != nil {
+		opts = append(opts, otlptracegrpc.WithTLSCredentials(credentials.NewTLS(cfg.tls)))
+	} else if cfg.insecure() {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	return otlptracegrpc.New(ctx, opts...)
+}
+
+func initTracer(ratio float64, propagator propagation.TextMapPropagator, otlp *otlpConfig) *sdktrace.TracerProvider {
 	ctx := context.Background()
 	
-	exporter, err := otlptracegrpc.New(ctx)
+	exporter, err := newTraceExporter(ctx, otlp)
 	if err != nil {
-		log.Fatalf("failed to create exporter: %v", err)
+		fatal("Failed to create exporter", "error", err)
+	}
+
+	var processor sdktrace.SpanProcessor = sdktrace.NewBatchSpanProcessor(exporter)
+	if len(redactAttrs) > 0 {
+		processor = newRedactingProcessor(processor, redactAttrs)
 	}
 
 	tp := sdktrace.NewTracerProvider(
-		sdktrace.WithBatcher(exporter),
-		sdktrace.WithResource(resource.NewWithAttributes(
-			semconv.SchemaURL,
-			semconv.ServiceNameKey.String("dispatch"),
-		)),
+		sdktrace.WithSampler(forceSampler{sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))}),
+		sdktrace.WithSpanProcessor(processor),
+		sdktrace.WithResource(serviceResource()),
 	)
 	
     otel.SetTracerProvider(tp)
     
-	otel.SetTextMapPropagator(propagation.TraceContext{})
+	otel.SetTextMapPropagator(propagator)
 	
     return tp
 }
@@ -89,181 +206,1227 @@ func (h AMQPHeaderCarrier) Keys() []string {
 	return keys
 }
 
-func connectToRabbitMQ(uri string) *amqp.Connection {
-	for {
-		conn, err := amqp.Dial(uri)
+// backoffDelay returns the wait before retry attempt n (starting at 1),
+// doubling from base up to max with equal jitter
+func backoffDelay(attempt int, base, max time.Duration) time.Duration {
+	d := base
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if d <= 0 {
+		return 0
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// amqpURI builds the broker URI, escaping the credentials and vhost
+func amqpURI(scheme string, user string, password string, host string, port string, vhost string) string {
+	u := url.URL{
+		Scheme: scheme,
+		User:   url.UserPassword(user, password),
+		Host:   net.JoinHostPort(host, port),
+		Path:   "/",
+	}
+	if vhost != "/" {
+		u.Path = "/" + vhost
+		u.RawPath = "/" + url.PathEscape(vhost)
+	}
+
+	return u.String()
+}
+
+// redactURI hides the password in uri for logging
+func redactURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "invalid URI"
+	}
+
+	return u.Redacted()
+}
+
+func connectToRabbitMQ(uri string) (amqpConnection, int) {
+	for attempt := 1; ; attempt++ {
+		conn, err := dialAMQP(uri, amqp.Config{
+			Heartbeat:       amqpHeartbeat,
+			TLSClientConfig: amqpTLS,
+			Locale:          "en_US",
+			Dial:            amqp.DefaultDial(amqpDialTimeout),
+		})
 		if err == nil {
-			return conn
+			return conn, attempt
 		}
 
-		log.Println(err)
-		log.Printf("Reconnecting to %s\n", uri)
-		time.Sleep(1 * time.Second)
+		slog.Error("Failed to connect to RabbitMQ", "error", err)
+		if maxReconnects > 0 && attempt >= maxReconnects {
+			fatal("Giving up connecting to RabbitMQ", "uri", redactURI(uri), "attempts", attempt, "error", err)
+		}
+		delay := backoffDelay(attempt, reconnectBase, reconnectMax)
+		slog.Info("Reconnecting to RabbitMQ", "uri", redactURI(uri), "attempt", attempt, "delay", delay.String())
+		time.Sleep(delay)
 	}
 }
 
+// reconnectToRabbitMQ connects again after the connection was lost with
+// cause, recording the outage in a span of its own so gaps in processing can
+// be matched to it
+func reconnectToRabbitMQ(uri string, cause *amqp.Error) amqpConnection {
+	ctx, span := otel.Tracer("dispatch-service").Start(context.Background(), "reconnectRabbitMQ")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("messaging.system", "rabbitmq"),
+		attribute.Int("rabbitmq.close_code", cause.Code),
+		attribute.String("rabbitmq.close_reason", cause.Reason),
+	)
+
+	conn, attempts := connectToRabbitMQ(uri)
+	span.SetAttributes(attribute.Int("rabbitmq.connect_attempts", attempts))
+	recordReconnect(ctx)
+
+	return conn
+}
+
+// downtimeClock is the clock downtime is measured with
+var downtimeClock = time.Now
+
+// downtimeSince returns how long the connection has been down since it was
+// lost at since
+func downtimeSince(since time.Time) time.Duration {
+	return max(downtimeClock().Sub(since), 0)
+}
+
+// recordDowntime records the time from losing the connection at since until
+// consuming could start again, in a span covering it
+func recordDowntime(since time.Time, cause *amqp.Error) {
+	downtime := downtimeSince(since)
+
+	_, span := otel.Tracer("dispatch-service").Start(context.Background(), "rabbitmqDowntime", trace.WithTimestamp(since))
+	span.SetAttributes(
+		attribute.String("messaging.system", "rabbitmq"),
+		attribute.Int64("rabbitmq.downtime_ms", downtime.Milliseconds()),
+		attribute.Int("rabbitmq.close_code", cause.Code),
+		attribute.String("rabbitmq.close_reason", cause.Reason),
+	)
+	span.End(trace.WithTimestamp(since.Add(downtime)))
+
+	recordDowntimeMetric(context.Background(), downtime)
+	slog.Info("RabbitMQ connection restored", "downtime", downtime.String(), "cause", cause.Reason)
+}
+
 func rabbitConnector(uri string) {
 	var rabbitErr *amqp.Error
+	var consumerClosed, publisherClosed chan *amqp.Error
 
 	for {
-		rabbitErr = <-rabbitCloseError
+		select {
+		case rabbitErr = <-rabbitCloseError:
+		case chanErr, ok := <-consumerClosed:
+			if !ok {
+				consumerClosed = nil
+				continue
+			}
+			var err error
+			consumerClosed, err = recoverConsumer(chanErr)
+			if err == nil {
+				continue
+			}
+			rabbitErr = escalate(chanErr, err)
+		case chanErr, ok := <-publisherClosed:
+			if !ok {
+				publisherClosed = nil
+				continue
+			}
+			var err error
+			publisherClosed, err = recoverPublisher(chanErr)
+			if err == nil {
+				continue
+			}
+			rabbitErr = escalate(chanErr, err)
+		}
+
+		setConnected(false)
 		if rabbitErr == nil {
 			return
 		}
 
-		log.Printf("Connecting to %s\n", amqpUri)
-		rabbitConn := connectToRabbitMQ(uri)
+		// the first connection is not downtime
+		var downSince time.Time
+		if rabbitConn != nil {
+			downSince = downtimeClock()
+		}
+
+		slog.Info("Connecting to RabbitMQ", "uri", redactURI(uri))
+		var conn amqpConnection
+		if rabbitConn != nil {
+			conn = reconnectToRabbitMQ(uri, rabbitErr)
+		} else {
+			conn, _ = connectToRabbitMQ(uri)
+		}
+		rabbitConnMu.Lock()
+		rabbitConn = conn
+		rabbitConnMu.Unlock()
+
+		// the library closes the notify channel once the connection
+		// has gone, so each connection needs a fresh one
+		rabbitCloseError = make(chan *amqp.Error, 1)
 		rabbitConn.NotifyClose(rabbitCloseError)
 
 		var err error
+		consumerClosed, publisherClosed, err = openChannels(rabbitConn)
+		failOnError(err, "Failed to set up channels")
+		slog.Info("Connected to RabbitMQ")
+
+		// signal ready
+		rabbitReady <- rabbitChan
+		if !downSince.IsZero() {
+			recordDowntime(downSince, rabbitErr)
+		}
+	}
+}
+
+// currentRabbitConn returns the RabbitMQ connection, nil before the first
+// connection is made
+func currentRabbitConn() amqpConnection {
+	rabbitConnMu.Lock()
+	defer rabbitConnMu.Unlock()
+
+	return rabbitConn
+}
+
+// queueArgs returns the declare arguments of the orders queues. Rejected
+// orders go to the dead letter exchange unless DISPATCH_DEAD_LETTER_ARGS is
+// turned off
+func queueArgs() amqp.Table {
+	args := amqp.Table{}
+	if deadLetterArgs {
+		args["x-dead-letter-exchange"] = deadLetterExchange
+	}
+	if queueType != "classic" {
+		args["x-queue-type"] = queueType
+	}
+	if queueTTL > 0 {
+		args["x-message-ttl"] = queueTTL.Milliseconds()
+	}
+	if queueMaxLength > 0 {
+		args["x-max-length"] = int64(queueMaxLength)
+	}
+	if queueMaxPriority > 0 {
+		args["x-max-priority"] = int64(queueMaxPriority)
+	}
+
+	return args
+}
+
+// declareTopology sets the prefetch of the consumer channel ch and declares
+// the exchanges and queues on it
+func declareTopology(ch amqpChannel) error {
+	var err error
+
+	// limit unacknowledged deliveries held by this consumer
+	err = ch.Qos(prefetch, 0, false)
+	if err != nil {
+		return fmt.Errorf("setting QoS: %w", err)
+	}
+	slog.Info("Prefetch set", "prefetch", prefetch)
 
-		// create mappings here
-		rabbitChan, err = rabbitConn.Channel()
-		failOnError(err, "Failed to create channel")
+	// create exchange
+	err = ch.ExchangeDeclare(exchangeName, exchangeType, true, false, false, false, nil)
+	if err != nil {
+		var amqpErr *amqp.Error
+		if errors.As(err, &amqpErr) && amqpErr.Code == amqp.PreconditionFailed {
+			slog.Error("Exchange already exists with a different type, set DISPATCH_EXCHANGE_TYPE to the type it was declared with",
+				"exchange", exchangeName, "type", exchangeType, "error", amqpErr.Reason)
+		}
+		return fmt.Errorf("creating exchange: %w", err)
+	}
 
-		// create exchange
-		err = rabbitChan.ExchangeDeclare("robot-shop", "direct", true, false, false, false, nil)
-		failOnError(err, "Failed to create exchange")
+	// create dead letter and retry queues
+	err = declareDeadLetter(ch)
+	if err != nil {
+		return fmt.Errorf("creating dead letter queue: %w", err)
+	}
 
-		// create queue
-		queue, err := rabbitChan.QueueDeclare("orders", true, false, false, false, nil)
-		failOnError(err, "Failed to create queue")
+	// create a queue for each tenant
+	args := queueArgs()
+	for _, tenant := range consumedTenants() {
+		queue, err := ch.QueueDeclare(tenantQueue(tenant), true, false, false, false, args)
+		if err != nil {
+			var amqpErr *amqp.Error
+			if errors.As(err, &amqpErr) && amqpErr.Code == amqp.PreconditionFailed {
+				slog.Error("Queue already exists with different arguments, delete it so it can be declared with the current settings, or set DISPATCH_DEAD_LETTER_ARGS=false if it was declared without a dead letter exchange",
+					"queue", tenantQueue(tenant), "arguments", args)
+			}
+			return fmt.Errorf("creating queue: %w", err)
+		}
 
 		// bind queue to exchange
-		err = rabbitChan.QueueBind(queue.Name, "orders", "robot-shop", false, nil)
-		failOnError(err, "Failed to bind queue")
+		err = bindQueue(ch, queue.Name, tenantKeys(tenant))
+		if err != nil {
+			return fmt.Errorf("binding queue: %w", err)
+		}
 
-		// signal ready
-		rabbitReady <- true
+		// delayed retries are routed back by queue name
+		if delayedRetry {
+			err = ch.QueueBind(queue.Name, queue.Name, delayedExchange, false, nil)
+			if err != nil {
+				return fmt.Errorf("binding queue to delayed exchange: %w", err)
+			}
+		}
 	}
+
+	// create confirmation exchanges that are not the shared one
+	for _, exchange := range confirmExchanges() {
+		err = ch.ExchangeDeclare(exchange, "direct", true, false, false, false, nil)
+		if err != nil {
+			return fmt.Errorf("creating confirmation exchange %s: %w", exchange, err)
+		}
+	}
+
+	return nil
+}
+
+// openChannels opens the consumer and publisher channels on conn and
+// declares the exchanges and queues, returning a notification channel for
+// each that receives the error if the broker closes it
+func openChannels(conn amqpConnection) (chan *amqp.Error, chan *amqp.Error, error) {
+	consumerClosed, err := openConsumer(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	publisherClosed := make(chan *amqp.Error, 1)
+	err = openPublisher(conn, publisherClosed)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating publish channel: %w", err)
+	}
+
+	return consumerClosed, publisherClosed, nil
+}
+
+// openConsumer opens the consumer channel on conn and declares the exchanges
+// and queues on it, returning a notification channel that receives the error
+// if the broker closes it
+func openConsumer(conn amqpConnection) (chan *amqp.Error, error) {
+	var err error
+
+	// create mappings here
+	rabbitChan, err = conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("creating channel: %w", err)
+	}
+
+	err = declareTopology(rabbitChan)
+	if err != nil {
+		// a failure on our side leaves the channel open
+		rabbitChan.Close()
+		return nil, err
+	}
+
+	consumerClosed := make(chan *amqp.Error, 1)
+	rabbitChan.NotifyClose(consumerClosed)
+
+	return consumerClosed, nil
+}
+
+// recoverConsumer reopens the consumer channel on the current connection
+// after the broker closed it, leaving the publishing channels as they are so
+// the connection does not have to be dropped
+func recoverConsumer(cause *amqp.Error) (chan *amqp.Error, error) {
+	slog.Warn("RabbitMQ channel closed, reopening", "channel", "consumer", "error", cause)
+	setConnected(false)
+
+	if rabbitConn.IsClosed() {
+		return nil, amqp.ErrClosed
+	}
+
+	consumerClosed, err := openConsumer(rabbitConn)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Recovered RabbitMQ consumer channel without reconnecting")
+
+	rabbitReady <- rabbitChan
+
+	return consumerClosed, nil
+}
+
+// recoverPublisher reopens the publishing channels on the current connection
+// after the broker closed one of them, consuming carries on meanwhile
+func recoverPublisher(cause *amqp.Error) (chan *amqp.Error, error) {
+	slog.Warn("RabbitMQ channel closed, reopening", "channel", "publisher", "error", cause)
+
+	if rabbitConn.IsClosed() {
+		return nil, amqp.ErrClosed
+	}
+
+	closePublisher()
+	publisherClosed := make(chan *amqp.Error, 1)
+	if err := openPublisher(rabbitConn, publisherClosed); err != nil {
+		return nil, fmt.Errorf("creating publish channel: %w", err)
+	}
+	slog.Info("Recovered RabbitMQ publish channels without reconnecting")
+
+	return publisherClosed, nil
+}
+
+// escalate drops the connection after recovering from cause failed with err,
+// returning cause for rabbitConnector to reconnect with so the outage is
+// put down to what closed the channel
+func escalate(cause *amqp.Error, err error) *amqp.Error {
+	slog.Error("Channel recovery failed, reconnecting", "cause", cause, "error", err)
+	rabbitConn.Close()
+
+	return cause
+}
+
+// oversized reports whether the body of d is larger than DISPATCH_MAX_BODY_BYTES
+func oversized(d Delivery) bool {
+	return maxBodyBytes > 0 && len(d.Body) > maxBodyBytes
+}
+
+// truncate returns body as a string of at most max bytes for logging
+func truncate(body []byte, max int) string {
+	if len(body) <= max {
+		return string(body)
+	}
+
+	return string(body[:max]) + "..."
+}
+
+// deliveryLogAttrs describes a delivery for the logs. Bodies may hold
+// customer details so only the order id is logged unless DISPATCH_LOG_BODIES
+// is set, in which case the truncated body and the headers are logged
+func deliveryLogAttrs(d Delivery) []any {
+	if !logBodies {
+		// oversized bodies are never parsed
+		if oversized(d) {
+			return []any{"orderid", "unknown", "body_bytes", len(d.Body)}
+		}
+		return []any{"orderid", getOrderId(d.Body, d.ContentType, d.ContentEncoding)}
+	}
+
+	return []any{"body", truncate(d.Body, maxLoggedBody), "headers", d.Headers}
+}
+
+// splitList splits a comma separated list, dropping empty entries
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// getEnv returns the value of the environment variable key, or def when it
+// is unset
+func getEnv(key string, def string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+
+	return def
+}
+
+// bindQueue binds queue to the exchange with each of keys
+func bindQueue(ch amqpChannel, queue string, keys []string) error {
+	for _, key := range keys {
+		if err := ch.QueueBind(queue, key, exchangeName, false, nil); err != nil {
+			return fmt.Errorf("binding %s: %w", key, err)
+		}
+		slog.Info("Bound queue", "queue", queue, "exchange", exchangeName, "routing_key", key)
+	}
+
+	return nil
 }
 
 func failOnError(err error, msg string) {
 	if err != nil {
-		log.Fatalf("%s : %s", msg, err)
+		fatal(msg, "error", err)
 	}
 }
 
-func getOrderId(order []byte) string {
-	id := "unknown"
-	var f interface{}
-	err := json.Unmarshal(order, &f)
-	if err == nil {
-		m := f.(map[string]interface{})
-		id = m["orderid"].(string)
+func getOrderId(order []byte, contentType, contentEncoding string) string {
+	order, err := decodeBody(order, contentEncoding)
+	if err != nil {
+		return "unknown"
+	}
+
+	if isProtobuf(contentType) {
+		msg, err := decodeOrder(order, contentType)
+		if err != nil || msg.OrderID == "" {
+			return "unknown"
+		}
+		return string(msg.OrderID)
+	}
+
+	var msg struct {
+		OrderID orderID `json:"orderid"`
+	}
+	if err := json.Unmarshal(order, &msg); err != nil || msg.OrderID == "" {
+		return "unknown"
 	}
 
-	return id
+	return string(msg.OrderID)
 }
 
-func createSpan(headers map[string]interface{}, order string) {
-	carrier := AMQPHeaderCarrier(headers)
-	ctx := otel.GetTextMapPropagator().Extract(context.Background(), carrier)
+func createSpan(ctx context.Context, d Delivery) (err error) {
+	inflightOrders.Add(1)
+	defer inflightOrders.Add(-1)
+
+	// orders processed in a batch are children of the batch span, linked to
+	// the span that produced them
+	var opts []trace.SpanStartOption
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		remote := otel.GetTextMapPropagator().Extract(context.Background(), d.Headers)
+		opts = append(opts, trace.WithLinks(trace.LinkFromContext(remote)))
+		ctx = baggage.ContextWithBaggage(ctx, baggage.FromContext(remote))
+	} else {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, d.Headers)
+	}
 
 	tracer := otel.Tracer("dispatch-service")
-	
-    log.Printf("order %s\n", order)
 
-	ctx, span := tracer.Start(ctx, "getOrder", trace.WithSpanKind(trace.SpanKindConsumer))
+	// hold the order here while over the rate limit, the next orders stay
+	// with the broker once all the workers are waiting
+	waitStart := time.Now()
+	if err := orderLimiter.Wait(ctx); err != nil {
+		return err
+	}
+	waited := time.Since(waitStart)
+
+	ctx, cancel := context.WithTimeout(ctx, orderTimeout)
+	defer cancel()
+
+	if forceSampled(d) {
+		opts = append(opts, trace.WithAttributes(forceSampleAttr.Bool(true)))
+	}
+
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, "getOrder", append(opts, trace.WithSpanKind(trace.SpanKindConsumer))...)
 	defer span.End()
 
-	fakeDataCenter := dataCenters[rand.Intn(len(dataCenters))]
+	// mark the span failed before processDelivery recovers the panic
+	defer func() {
+		if r := recover(); r != nil {
+			span.RecordError(fmt.Errorf("panic processing order: %v", r), trace.WithStackTrace(true))
+			span.SetStatus(codes.Error, fmt.Sprint("panic processing order: ", r))
+			panic(r)
+		}
+	}()
+
+	// legacy keys are kept alongside the current ones for older dashboards
 	span.SetAttributes(
-        attribute.String("datacenter", fakeDataCenter),
-        attribute.String("messaging.system", "rabbitmq"),
-        attribute.String("messaging.destination", "robot-shop"),
-        attribute.String("messaging.destination_kind", "queue"),
-        attribute.String("messaging.operation", "process"),
-        attribute.String("orderid", order),
-    )
-
-	time.Sleep(time.Duration(42+rand.Int63n(42)) * time.Millisecond)
-	
-	if rand.Intn(100) < errorPercent {
-        // Record Error
-		span.RecordError(fmt.Errorf("Failed to dispatch to SOP"))
-		span.SetStatus(codes.Error, "Failed to dispatch to SOP")
-		log.Println("Span tagged with error")
+		attribute.String("messaging.system", broker.System()),
+		attribute.String("messaging.destination", exchangeName),
+		attribute.String("messaging.destination_kind", "queue"),
+		attribute.String("messaging.operation", "process"),
+		attribute.String("messaging.destination.name", exchangeName),
+		attribute.String("messaging.operation.type", "process"),
+	)
+	if d.MessageID != "" {
+		span.SetAttributes(attribute.String("messaging.message.id", d.MessageID))
+	}
+	span.SetAttributes(attribute.Int64("messaging.redelivery_count", d.Redeliveries))
+	if queueMaxPriority > 0 {
+		span.SetAttributes(attribute.Int("messaging.priority", int(d.Priority)))
+	}
+	if age, ok := recordMessageAge(ctx, d.Timestamp, waitStart); ok {
+		span.SetAttributes(attribute.Int64("messaging.message.age_ms", age.Milliseconds()))
+	}
+	if dryRun {
+		span.SetAttributes(attribute.Bool("dry_run", true))
 	}
+	if waited >= time.Millisecond {
+		span.AddEvent("rate_limited", trace.WithAttributes(attribute.Int64("wait_ms", waited.Milliseconds())))
+	}
+
+	// tenant is known from the queue, or passed along as baggage by
+	// upstream services
+	tenant := d.Tenant
+	if tenant == "" {
+		tenant = baggage.FromContext(ctx).Member("tenant").Value()
+	}
+	if tenant != "" {
+		span.SetAttributes(attribute.String("tenant", tenant))
+	}
+
+	// the correlation id rides along in the baggage to the confirmation
+	corrID := d.CorrelationID
+	if corrID == "" {
+		corrID = correlationID(ctx)
+	}
+	if corrID == "" {
+		corrID = newCorrelationID()
+		span.AddEvent("correlation_id_generated")
+	}
+	ctx = withCorrelationID(ctx, corrID)
+	span.SetAttributes(attribute.String("messaging.message.conversation_id", corrID))
+
+	// deliveries repeated by the producer or broker are acked and skipped
+	if recentMessages != nil && d.MessageID != "" && recentMessages.Contains(d.MessageID) {
+		span.AddEvent("duplicate_delivery")
+		slog.InfoContext(ctx, "Skipping duplicate delivery", "message_id", d.MessageID)
+		return nil
+	}
+
+	if oversized(d) {
+		err := fmt.Errorf("%w: body of %d bytes exceeds %d", errOversized, len(d.Body), maxBodyBytes)
+		span.AddEvent("oversized_message", trace.WithAttributes(
+			attribute.Int("messaging.message.body.size", len(d.Body)),
+			attribute.Int("max_body_bytes", maxBodyBytes),
+		))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		slog.ErrorContext(ctx, "Oversized message", "error", err)
+		recordOrder(ctx, "unknown", start, err)
+		return err
+	}
+
+	order, err := parseOrderSpan(ctx, tracer, d)
+	if err != nil {
+		span.SetAttributes(attribute.String("orderid", getOrderId(d.Body, d.ContentType, d.ContentEncoding)))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		slog.ErrorContext(ctx, "Invalid order", "error", err)
+		recordOrder(ctx, "unknown", start, err)
+		return err
+	}
+
+	// redelivered orders that were already dispatched are acked and skipped
+	seen, seenErr := seenOrders.Contains(ctx, order.OrderID)
+	if seenErr != nil {
+		slog.WarnContext(ctx, "Failed to check for duplicate order", "orderid", order.OrderID, "error", seenErr)
+	}
+	if seen {
+		span.SetAttributes(attribute.String("orderid", order.OrderID))
+		span.AddEvent("duplicate_order")
+		slog.InfoContext(ctx, "Skipping duplicate order", "orderid", order.OrderID)
+		return nil
+	}
+
+	span.SetName(spanName(order.Type))
+	order.SpanContext = span.SpanContext()
+	dataCenter := selectDataCenter(order)
+	span.SetAttributes(
+		attribute.String("orderid", order.OrderID),
+		attribute.String("destination", order.Destination),
+		attribute.String("datacenter", dataCenter),
+		attribute.Float64("order.total", order.Total),
+		attribute.Int("order.item_count", order.ItemCount()),
+		attribute.Float64("dispatch.shipping_cost", estimateShippingCost(order, dataCenter)),
+	)
+
+	logOrder(ctx, "Processing order", "orderid", order.OrderID, "datacenter", dataCenter)
+
+	if sleep(ctx, simulatedLatency()) == nil {
+		if !sopBreaker.Allow() {
+			// fail fast without calling the SOP
+			err = errCircuitOpen
+			span.AddEvent("circuit_open")
+			slog.WarnContext(ctx, "SOP circuit open, requeueing order", "orderid", order.OrderID)
+		} else {
+			// orders matching the fail pattern always fail, others at random
+			if failPattern != nil && failPattern.MatchString(order.OrderID) {
+				err = transient(fmt.Errorf("Failed to dispatch to SOP, order id matches %s", failPattern))
+			} else if rand.Intn(100) < int(errorPercent.Load()) {
+				err = transient(fmt.Errorf("Failed to dispatch to SOP"))
+			}
+
+			if err != nil {
+				// Record Error
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+				slog.ErrorContext(ctx, "Span tagged with error", "orderid", order.OrderID, "datacenter", dataCenter, "error", err)
+				sopBreaker.Failure()
+			} else {
+				sopBreaker.Success()
+			}
 
-	processSale(ctx, tracer)
+			// a cancelled sale is retried, unless the SOP already failed
+			if _, saleErr := processSale(ctx, tracer, order.OrderID, dataCenter); err == nil {
+				err = saleErr
+			}
+		}
+	}
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = transient(fmt.Errorf("order timed out after %s", orderTimeout))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		slog.ErrorContext(ctx, "Order timed out", "orderid", order.OrderID, "timeout", orderTimeout.String())
+	} else if ctx.Err() != nil && err == nil {
+		err = ctx.Err()
+	}
+
+	// dry runs leave the confirmations, duplicate detection and audit
+	// trail untouched
+	if err == nil && !dryRun {
+		err = publishConfirmation(ctx, tracer, Confirmation{
+			OrderID:    order.OrderID,
+			DataCenter: dataCenter,
+			Status:     "dispatched",
+			DurationMs: float64(time.Since(start)) / float64(time.Millisecond),
+		})
+		if err != nil && !requeueUnconfirmed {
+			// the order was dispatched, only the confirmation is lost
+			err = nil
+		}
+	} else if err != nil && !dryRun && finalFailure(err, d.Redeliveries) {
+		// downstream services are told about orders that will not be
+		// tried again, even when the order timed out
+		failed := Confirmation{
+			OrderID:    order.OrderID,
+			DataCenter: dataCenter,
+			Status:     "failed",
+			DurationMs: float64(time.Since(start)) / float64(time.Millisecond),
+			Error:      err.Error(),
+		}
+		if pubErr := publishConfirmation(context.WithoutCancel(ctx), tracer, failed); pubErr != nil {
+			slog.WarnContext(ctx, "Failed to publish failure confirmation", "orderid", order.OrderID, "error", pubErr)
+		}
+	}
+
+	if err == nil && !dryRun {
+		if seenErr := seenOrders.Add(ctx, order.OrderID); seenErr != nil {
+			slog.WarnContext(ctx, "Failed to record dispatched order", "orderid", order.OrderID, "error", seenErr)
+		}
+		if recentMessages != nil && d.MessageID != "" {
+			recentMessages.Add(d.MessageID)
+		}
+
+		// the audit trail is best effort and never fails the order
+		record := DispatchRecord{
+			OrderID:      order.OrderID,
+			DataCenter:   dataCenter,
+			Status:       "dispatched",
+			DispatchedAt: time.Now().UTC(),
+		}
+		if storeErr := saveDispatch(ctx, record); storeErr != nil {
+			slog.ErrorContext(ctx, "Failed to store dispatch record", "orderid", order.OrderID, "error", storeErr)
+		}
+	}
+
+	if err == nil {
+		span.SetStatus(codes.Ok, "")
+	}
+	recordOrder(ctx, dataCenter, start, err)
+
+	return err
 }
 
-func processSale(ctx context.Context, tracer trace.Tracer) {
-	_, span := tracer.Start(ctx, "processSale")
+// acknowledge settles a manually acked delivery once processing has finished,
+// as classify says. Invalid orders can never succeed so are dropped,
+// permanent failures such as oversized messages are dead-lettered, orders
+// skipped by the open SOP circuit are requeued straight away, and other
+// failed orders are retried via the retry queue until they have failed
+// maxRetries times, then rejected to the dead letter queue
+func acknowledge(d amqp.Delivery, tenant string, err error) {
+	switch classify(err) {
+	case dispositionDrop:
+		slog.Warn("Dropping invalid order", append(deliveryLogAttrs(amqpDelivery(d, tenant)), "error", err)...)
+
+	case dispositionDeadLetter:
+		slog.Warn("Dead lettering order", "body_bytes", len(d.Body), "error", err)
+		if rejectErr := d.Reject(false); rejectErr != nil {
+			slog.Error("Failed to reject message", "error", rejectErr)
+		}
+		return
+
+	case dispositionRequeue:
+		if nackErr := d.Nack(false, true); nackErr != nil {
+			slog.Error("Failed to nack message", "error", nackErr)
+		}
+		return
+
+	case dispositionRetry:
+		retries := retryCount(d.Headers, tenant)
+		if retries >= int64(maxRetries) {
+			slog.Warn("Dead lettering order", "retries", retries, "error", err)
+			if rejectErr := d.Reject(false); rejectErr != nil {
+				slog.Error("Failed to reject message", "error", rejectErr)
+			}
+			return
+		}
+
+		slog.Warn("Retrying order", "attempt", retries+1, "error", err)
+		if retryErr := retryLater(d, tenant); retryErr != nil {
+			slog.Error("Failed to queue retry, requeueing order", "error", retryErr)
+			if nackErr := d.Nack(false, true); nackErr != nil {
+				slog.Error("Failed to nack message", "error", nackErr)
+			}
+			return
+		}
+	}
+
+	if ackErr := d.Ack(false); ackErr != nil {
+		slog.Error("Failed to ack message", "error", ackErr)
+	}
+}
+
+// parseOrderSpan parses the order in d in a child span, making the time
+// spent decoding large bodies visible
+func parseOrderSpan(ctx context.Context, tracer trace.Tracer, d Delivery) (*Order, error) {
+	_, span := tracer.Start(ctx, "parseOrder")
 	defer span.End()
-	
-    span.AddEvent("Order sent for processing")
-	
-    time.Sleep(time.Duration(42+rand.Int63n(42)) * time.Millisecond)
+
+	span.SetAttributes(attribute.Int("messaging.message.body.size", len(d.Body)))
+	if d.ContentType != "" {
+		span.SetAttributes(attribute.String("content_type", d.ContentType))
+	}
+
+	if d.ContentEncoding != "" {
+		span.SetAttributes(attribute.String("content_encoding", d.ContentEncoding))
+	}
+
+	body, err := decodeBody(d.Body, d.ContentEncoding)
+	var order *Order
+	if err == nil {
+		order, err = parseOrder(body, d.ContentType)
+	}
+	span.SetAttributes(attribute.Bool("decoded", err == nil))
+	// the configured order fields go on the order span, not this one
+	if err == nil && len(spanAttrFields) > 0 && !isProtobuf(d.ContentType) {
+		trace.SpanFromContext(ctx).SetAttributes(orderFieldAttrs(body)...)
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	return order, err
+}
+
+// processDelivery processes d, a panic anywhere in doing so fails the
+// order rather than the whole service
+func processDelivery(ctx context.Context, d Delivery) (err error) {
+	start := time.Now()
+	defer func() {
+		if r := recover(); r != nil {
+			// the same order would only panic again
+			err = permanent(fmt.Errorf("panic processing order: %v", r))
+			slog.ErrorContext(ctx, "Recovered from panic", "error", err, "stack", string(debug.Stack()))
+			recordOrder(ctx, "unknown", start, err)
+		}
+	}()
+
+	return createSpan(ctx, d)
+}
+
+// settleDelivery settles d with err, logging a panic rather than letting it
+// take down the service
+func settleDelivery(d Delivery, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("Recovered from panic settling order", "message_id", d.MessageID, "panic", r, "stack", string(debug.Stack()))
+		}
+	}()
+
+	d.Settle(err)
+}
+
+// consumeOrders hands deliveries to the workers until the deliveries channel
+// closes or ctx is cancelled. The orders are processed under orders, which
+// outlives ctx so that a shutdown lets the orders being processed finish
+func consumeOrders(ctx, orders context.Context, msgs <-chan Delivery, workers chan struct{}) {
+	for {
+		var d Delivery
+		var ok bool
+
+		select {
+		case <-ctx.Done():
+			return
+		case d, ok = <-msgs:
+			if !ok {
+				return
+			}
+		}
+
+		orderCtx := withOrderLogs(orders, sampleOrderLogs())
+		logOrder(orderCtx, "Order received", deliveryLogAttrs(d)...)
+
+		// blocks while all workers are busy, leaving the
+		// remaining messages with the broker
+		workers <- struct{}{}
+		inflight.Add(1)
+
+		// process and settle the order in the same goroutine
+		go func(d Delivery) {
+			defer inflight.Done()
+			defer func() { <-workers }()
+			err := processDelivery(orderCtx, d)
+			if dryRun {
+				// acked whatever the outcome so nothing is retried or
+				// dead-lettered
+				err = nil
+			}
+			settleDelivery(d, err)
+		}(d)
+	}
+}
+
+// processSale simulates sending the order to the SOP, returning the headers
+// the call would carry. It stops early once ctx is done, on shutdown or when
+// the order times out, returning why
+func processSale(ctx context.Context, tracer trace.Tracer, orderID, dataCenter string) (propagation.MapCarrier, error) {
+	ctx, span := tracer.Start(ctx, "processSale")
+	defer span.End()
+
+	if dataCenter != "" {
+		span.SetAttributes(attribute.String("datacenter", dataCenter))
+	}
+
+	// what a real call to the SOP would carry
+	carrier := sopCarrier(ctx, orderID, dataCenter)
+	slog.DebugContext(ctx, "SOP request baggage", "orderid", orderID, "baggage", carrier.Get("baggage"))
+
+	span.AddEvent("Order sent for processing")
+	logOrder(ctx, "Order sent for processing")
+
+	if err := sleep(ctx, saleLatency(dataCenter)); err != nil {
+		err = fmt.Errorf("processing sale cancelled: %w", err)
+		span.AddEvent("cancelled", trace.WithAttributes(attribute.String("cause", context.Cause(ctx).Error())))
+		span.SetStatus(codes.Error, err.Error())
+		return carrier, err
+	}
+	span.SetStatus(codes.Ok, "")
+
+	return carrier, nil
+}
+
+// simulatedLatency returns how long a simulated step of the dispatch takes
+func simulatedLatency() time.Duration {
+	return jitteredLatency(latencyBase)
+}
+
+// saleLatency returns how long processing a sale takes in dataCenter
+func saleLatency(dataCenter string) time.Duration {
+	base, ok := dataCenterLatency[dataCenter]
+	if !ok {
+		base = latencyBase
+	}
+
+	return jitteredLatency(base)
+}
+
+// jitteredLatency returns base milliseconds plus up to the configured jitter
+func jitteredLatency(base int) time.Duration {
+	ms := int64(base)
+	if latencyJitter > 0 {
+		ms += rand.Int63n(int64(latencyJitter))
+	}
+
+	return time.Duration(ms) * time.Millisecond
+}
+
+// processBatch sends a batch of orders to the SOP in a single span, linked
+// to the span of each order rather than nested under any one of them
+func processBatch(ctx context.Context, orders []*Order) error {
+	tracer := otel.Tracer("dispatch-service")
+
+	links := make([]trace.Link, 0, len(orders))
+	for _, order := range orders {
+		links = append(links, trace.Link{
+			SpanContext: order.SpanContext,
+			Attributes:  []attribute.KeyValue{attribute.String("orderid", order.OrderID)},
+		})
+	}
+
+	ctx, span := tracer.Start(ctx, "processBatch", trace.WithLinks(links...))
+	defer span.End()
+
+	span.SetAttributes(attribute.Int("batch.size", len(orders)))
+
+	// a batch may span data centers so takes the base latency
+	_, err := processSale(ctx, tracer, "", "")
+	return err
+}
+
+// sleep pauses for d or until ctx is done, returning the context error if it
+// ended first
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// waitForInflight waits up to timeout for orders being processed to finish,
+// reporting whether they did
+func waitForInflight(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		slog.Info("All in-flight orders finished")
+		return true
+	case <-time.After(timeout):
+		slog.Warn("Timed out waiting for in-flight orders", "timeout", timeout.String(), "inflight", inflightOrders.Load())
+		return false
+	}
 }
 
 func main() {
 	rand.Seed(time.Now().Unix())
 
-	tp := initTracer()
+	initLogger()
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	logLevel.Set(cfg.LogLevel)
+
+	resourceAttrs = cfg.ResourceAttributes
+	redactAttrs = cfg.RedactAttrs
+	spanAttrFields = cfg.SpanAttrFields
+	tp := initTracer(cfg.SamplingRatio, cfg.Propagator, cfg.OTLP)
 	defer func() {
 		if err := tp.Shutdown(context.Background()); err != nil {
-			log.Printf("Error shutting down tracer provider: %v", err)
+			slog.Error("Error shutting down tracer provider", "error", err)
 		}
 	}()
 
-	// Init amqpUri
-	// get host from environment
-	amqpHost, ok := os.LookupEnv("AMQP_HOST")
-	if !ok {
-		amqpHost = "rabbitmq"
-	}
-	amqpUri = fmt.Sprintf("amqp://guest:guest@%s:5672/", amqpHost)
+	mp := initMeter(cfg.OTLP)
+	defer func() {
+		if err := mp.Shutdown(context.Background()); err != nil {
+			slog.Error("Error shutting down meter provider", "error", err)
+		}
+	}()
 
-	// get error threshold from environment
-	errorPercent = 0
-	epct, ok := os.LookupEnv("DISPATCH_ERROR_PERCENT")
-	if ok {
-		epcti, err := strconv.Atoi(epct)
-		if err == nil {
-			if epcti > 100 {
-				epcti = 100
-			}
-			if epcti < 0 {
-				epcti = 0
+	if cfg.LogsEnabled {
+		lp := initLogExport(cfg.OTLP)
+		defer func() {
+			if err := lp.Shutdown(context.Background()); err != nil {
+				slog.Error("Error shutting down logger provider", "error", err)
 			}
-			errorPercent = epcti
+		}()
+	}
+
+	switch cfg.Broker {
+	case "amqp":
+		broker = amqpBroker{}
+	case "nats":
+		broker = newNATSBroker(cfg.NATSURL)
+	}
+	slog.Info("Message broker", "broker", broker.System())
+
+	amqpUri = cfg.AMQPURI
+	amqpTLS = cfg.AMQPTLS
+	amqpHeartbeat = cfg.AMQPHeartbeat
+	amqpDialTimeout = cfg.AMQPDialTimeout
+	slog.Info("AMQP TLS", "enabled", amqpTLS != nil)
+	slog.Info("AMQP connection", "heartbeat", amqpHeartbeat.String(), "dial_timeout", amqpDialTimeout.String())
+
+	exchangeName = cfg.Exchange
+	exchangeType = cfg.ExchangeType
+	queueName = cfg.Queue
+	routingKeys = cfg.RoutingKeys
+	tenants = cfg.Tenants
+	queueType = cfg.QueueType
+	queueTTL = cfg.QueueTTL
+	queueMaxLength = cfg.QueueMaxLength
+	queueMaxPriority = cfg.MaxPriority
+	deadLetterExchange = exchangeName + ".dlx"
+	deadLetterQueue = queueName + ".dlq"
+	delayedExchange = exchangeName + ".delayed"
+	deadLetterArgs = cfg.DeadLetterArgs
+	consumerTag = cfg.ConsumerTag
+	slog.Info("Consuming", "exchange", exchangeName, "exchange_type", exchangeType, "queue", queueName, "routing_keys", routingKeys, "tenants", tenants, "tag", consumerTag)
+	slog.Info("Queue", "type", queueType, "ttl", queueTTL.String(), "max_length", queueMaxLength, "max_priority", queueMaxPriority)
+	if !deadLetterArgs {
+		slog.Warn("DISPATCH_DEAD_LETTER_ARGS is off, rejected orders only reach the dead letter queue through a policy setting dead-letter-exchange on the orders queues",
+			"dead_letter_exchange", deadLetterExchange, "dead_letter_queue", deadLetterQueue)
+	}
+
+	manualAck = cfg.ManualAck
+	prefetch = cfg.Prefetch
+	maxConcurrency = cfg.MaxConcurrency
+	consumers = cfg.Consumers
+	maxRetries = cfg.MaxRetries
+	delayedRetry = cfg.DelayedRetry
+	batchSize = cfg.BatchSize
+	batchWindow = cfg.BatchWindow
+	if batchSize > 1 {
+		slog.Info("Consuming in batches", "size", batchSize, "window", batchWindow.String())
+		if batchSize > prefetch {
+			slog.Warn("Prefetch is below the batch size, batches only fill up to the prefetch", "prefetch", prefetch, "batch_size", batchSize)
 		}
 	}
-	log.Printf("Error Percent is %d\n", errorPercent)
+	orderTimeout = cfg.OrderTimeout
+	slog.Info("Processing", "manual_ack", manualAck, "prefetch", prefetch, "workers", maxConcurrency, "consumers", consumers, "max_retries", maxRetries, "delayed_retry", delayedRetry, "order_timeout", orderTimeout.String())
+	if cfg.RateLimit > 0 {
+		orderLimiter = rate.NewLimiter(rate.Limit(cfg.RateLimit), 1)
+		slog.Info("Rate limit", "per_second", cfg.RateLimit)
+	}
 
-	// MQ error channel
-	rabbitCloseError = make(chan *amqp.Error)
+	confirmTargets = cfg.ConfirmTargets
+	publishAttempts = cfg.PublishAttempts
+	publishChannels = cfg.PublishChannels
+	requeueUnconfirmed = cfg.RequeueUnconfirmed
+	targets := make([]string, 0, len(confirmTargets))
+	for _, t := range confirmTargets {
+		targets = append(targets, t.String())
+	}
+	slog.Info("Confirmation publishing", "targets", targets, "attempts", publishAttempts, "channels", publishChannels, "requeue_unconfirmed", requeueUnconfirmed)
 
-	// MQ ready channel
-	rabbitReady = make(chan bool)
+	reconnectBase = cfg.ReconnectBase
+	reconnectMax = cfg.ReconnectMax
+	maxReconnects = cfg.MaxReconnects
+	slog.Info("Reconnect backoff", "base", reconnectBase.String(), "max", reconnectMax.String(), "max_attempts", maxReconnects)
 
-	go rabbitConnector(amqpUri)
+	errorPercent.Store(int32(cfg.ErrorPercent))
+	failPattern = cfg.FailPattern
+	latencyBase = cfg.LatencyBase
+	latencyJitter = cfg.LatencyJitter
+	if cfg.DataCenterLatency != nil {
+		dataCenterLatency = cfg.DataCenterLatency
+	}
+	sopBreaker = newCircuitBreaker(cfg.BreakerThreshold, cfg.BreakerCooldown)
+	slog.Info("Simulated SOP", "error_percent", cfg.ErrorPercent, "fail_pattern", failPattern, "latency_base_ms", latencyBase, "latency_jitter_ms", latencyJitter,
+		"datacenter_latency_ms", dataCenterLatency, "breaker_threshold", cfg.BreakerThreshold, "breaker_cooldown", cfg.BreakerCooldown.String())
 
-	rabbitCloseError <- amqp.ErrClosed
+	if cfg.RedisAddr != "" {
+		seenOrders = newRedisSeenSet(cfg.RedisAddr, cfg.IdempotencyTTL)
+	} else {
+		seenOrders = newMemorySeenSet(cfg.IdempotencyTTL)
+	}
+	if cfg.MessageIDCache > 0 {
+		recentMessages = newLRUSet(cfg.MessageIDCache)
+	}
+	slog.Info("Duplicate detection", "ttl", cfg.IdempotencyTTL.String(), "redis", cfg.RedisAddr, "message_ids", cfg.MessageIDCache)
 
-	go func() {
-		for {
-			// wait for rabbit to be ready
-			ready := <-rabbitReady
-			log.Printf("Rabbit MQ ready %v\n", ready)
-
-			// subscribe to bound queue
-			msgs, err := rabbitChan.Consume("orders", "", true, false, false, false, nil)
-			failOnError(err, "Failed to consume")
-
-			for d := range msgs {
-				log.Printf("Order %s\n", d.Body)
-				log.Printf("Headers %v\n", d.Headers)
-				id := getOrderId(d.Body)
-				
-                // Call the updated createSpan
-				go createSpan(d.Headers, id)
-			}
+	if cfg.DatabaseDSN != "" {
+		pg, err := newPostgresStore(cfg.DatabaseDSN)
+		failOnError(err, "Failed to set up the dispatch store")
+		store = pg
+	}
+	defer func() {
+		if err := store.Close(); err != nil {
+			slog.Error("Error closing dispatch store", "error", err)
 		}
 	}()
+	slog.Info("Dispatch store", "enabled", cfg.DatabaseDSN != "")
+
+	if cfg.OrderSchema != "" {
+		orderSchema, err = loadOrderSchema(cfg.OrderSchema)
+		failOnError(err, "Invalid DISPATCH_ORDER_SCHEMA")
+	}
+	slog.Info("Order schema", "path", cfg.OrderSchema)
+
+	logBodies = cfg.LogBodies
+	logSampleN = int64(cfg.LogSampleN)
+	slog.Info("Order log sampling", "one_in", logSampleN)
+	maxBodyBytes = cfg.MaxBodyBytes
+	gzipMinBytes = cfg.PublishGzipBytes
+	sampleRatio = cfg.SamplingRatio
+	dryRun = cfg.DryRun
+	if dryRun {
+		slog.Warn("Dry run, orders are acked without confirmations or dispatch records")
+	}
+	shutdownTimeout = cfg.ShutdownTimeout
+	slog.Info("Log message bodies", "enabled", logBodies)
+	slog.Info("Max message body", "bytes", maxBodyBytes)
+	slog.Info("Gzip published messages", "min_bytes", gzipMinBytes)
+	slog.Info("Shutdown timeout", "timeout", shutdownTimeout.String())
+
+	adminToken = cfg.AdminToken
+	slog.Info("Admin endpoints", "token_required", adminToken != "")
+	initPrometheus(cfg.MetricsPrefix)
+	healthServer := startHealthServer(cfg.HealthPort, cfg.Profiling)
+
+	// cancelled on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// replicas started together spread their first connection attempts
+	if cfg.StartupJitter > 0 {
+		jitter := time.Duration(rand.Intn(cfg.StartupJitter)) * time.Millisecond
+		slog.Info("Startup jitter", "delay", jitter.String(), "max_ms", cfg.StartupJitter)
+		if err := sleep(ctx, jitter); err != nil {
+			slog.Info("Shut down during startup jitter")
+			return
+		}
+	}
+
+	msgs, err := broker.Consume(ctx)
+	failOnError(err, "Failed to consume")
+	// depth of the queues is read from RabbitMQ, 0 turns polling off
+	if cfg.Broker == "amqp" && cfg.QueueDepthInterval > 0 {
+		slog.Info("Polling queue depth", "interval", cfg.QueueDepthInterval.String())
+		go watchQueueDepth(ctx, cfg.QueueDepthInterval)
+	}
+	// the round trip is only tested through RabbitMQ
+	if cfg.SelfTest && cfg.Broker == "amqp" {
+		selfTest = true
+		slog.Info("Self test enabled, not ready until it passes")
+		go runSelfTest(ctx)
+	} else if cfg.SelfTest {
+		slog.Warn("Self test is only supported with the amqp broker")
+	}
+	if cfg.StartupTimeout > 0 {
+		slog.Info("Startup timeout", "timeout", cfg.StartupTimeout.String())
+		exitIfNeverConnected(cfg.StartupTimeout)
+	}
+
+	// one slot per order being processed
+	workers := make(chan struct{}, maxConcurrency)
 
-	log.Println("Waiting for messages")
-	select {}
+	if cfg.GenerateRate > 0 {
+		slog.Info("Generating synthetic orders", "per_second", cfg.GenerateRate)
+		go generateOrders(ctx, cfg.GenerateRate)
+	}
+
+	// orders being processed carry on after the signal, they are only
+	// cancelled once shutdownTimeout has passed
+	orders, cancelOrders := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelOrders()
+
+	// the consume loops share the workers
+	var consuming sync.WaitGroup
+	for range consumers {
+		consuming.Go(func() {
+			if batchSize > 1 {
+				consumeBatches(ctx, orders, msgs, workers)
+			} else {
+				consumeOrders(ctx, orders, msgs, workers)
+			}
+		})
+	}
+
+	slog.Info("Waiting for messages", "connected", isConnected())
+	<-ctx.Done()
+	stop()
+
+	slog.Info("Shutting down")
+	consuming.Wait()
+	if !waitForInflight(shutdownTimeout) {
+		// cancelled orders stop early and are requeued
+		cancelOrders()
+		waitForInflight(abortTimeout)
+	}
+
+	if err := healthServer.Shutdown(context.Background()); err != nil {
+		slog.Error("Error shutting down health server", "error", err)
+	}
+
+	if err := broker.Close(); err != nil {
+		slog.Error("Error closing broker connection", "error", err)
+	}
 }
@@ -0,0 +1,704 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric/noop"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+
+	"github.com/streadway/amqp"
+	"golang.org/x/time/rate"
+)
+
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	initInstruments(noop.NewMeterProvider().Meter("test"))
+	initPrometheus("test")
+
+	broker = &fakeBroker{}
+	sopBreaker = newCircuitBreaker(1000, time.Second)
+	seenOrders = newMemorySeenSet(time.Hour)
+	orderTimeout = 5 * time.Second
+	latencyBase, latencyJitter = 0, 0
+	publishAttempts = 1
+	maxRetries = 3
+	queueName = "orders"
+	routingKeys = []string{"orders"}
+	consumers = 1
+	exchangeName = "robot-shop"
+	exchangeType = "direct"
+	deadLetterExchange = "robot-shop.dlx"
+	deadLetterQueue = "orders.dlq"
+	confirmTargets = []confirmTarget{{"robot-shop", "dispatched"}}
+
+	os.Exit(m.Run())
+}
+
+// fakePublish is a message published through a fakeBroker
+type fakePublish struct {
+	exchange      string
+	key           string
+	body          []byte
+	correlationID string
+}
+
+// fakeBroker records what is published instead of sending it
+type fakeBroker struct {
+	mu        sync.Mutex
+	published []fakePublish
+
+	// called on each publish, its error is returned
+	onPublish func(exchange string, key string) error
+}
+
+func (b *fakeBroker) System() string {
+	return "fake"
+}
+
+func (b *fakeBroker) Consume(ctx context.Context) (<-chan Delivery, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+func (b *fakeBroker) Publish(ctx context.Context, exchange string, key string, body []byte) error {
+	if b.onPublish != nil {
+		if err := b.onPublish(exchange, key); err != nil {
+			return err
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.published = append(b.published, fakePublish{exchange, key, body, correlationID(ctx)})
+
+	return nil
+}
+
+func (b *fakeBroker) Close() error {
+	return nil
+}
+
+func (b *fakeBroker) messages() []fakePublish {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]fakePublish(nil), b.published...)
+}
+
+// useBroker makes b the broker for the rest of the test
+func useBroker(t *testing.T, b Broker) {
+	t.Helper()
+	prev := broker
+	broker = b
+	t.Cleanup(func() { broker = prev })
+}
+
+// recordSpans exports the spans started for the rest of the test to memory
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(tracenoop.NewTracerProvider())
+		tp.Shutdown(context.Background())
+	})
+
+	return exporter
+}
+
+// spanAttrs returns the attributes of span by key
+func spanAttrs(span tracetest.SpanStub) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value, len(span.Attributes))
+	for _, attr := range span.Attributes {
+		attrs[attr.Key] = attr.Value
+	}
+
+	return attrs
+}
+
+// orderBody returns a valid JSON order with id
+func orderBody(id string) []byte {
+	return fmt.Appendf(nil, `{"orderid":%q,"user":"test","cart":{"total":10,"items":[{"sku":"RB1","name":"Robot","qty":1,"price":10,"subtotal":10}]}}`, id)
+}
+
+var lastID atomic.Int64
+
+// uniqueID returns an order id not used by any other test
+func uniqueID(t *testing.T) string {
+	return fmt.Sprintf("%s-%d", t.Name(), lastID.Add(1))
+}
+
+// findSpan returns the first span named name that was exported
+func findSpan(t *testing.T, spans *tracetest.InMemoryExporter, name string) tracetest.SpanStub {
+	t.Helper()
+	for _, span := range spans.GetSpans() {
+		if span.Name == name {
+			return span
+		}
+	}
+	t.Fatalf("no %s span", name)
+
+	return tracetest.SpanStub{}
+}
+
+func TestConsumeOrdersConcurrency(t *testing.T) {
+	const workers = 4
+
+	var mu sync.Mutex
+	var peak int64
+	useBroker(t, &fakeBroker{onPublish: func(string, string) error {
+		mu.Lock()
+		peak = max(peak, inflightOrders.Load())
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		return nil
+	}})
+
+	msgs := make(chan Delivery)
+	var settled sync.WaitGroup
+	go func() {
+		for range 40 {
+			settled.Add(1)
+			msgs <- Delivery{
+				Headers: propagation.MapCarrier{},
+				Body:    orderBody(uniqueID(t)),
+				settle:  func(error) { settled.Done() },
+			}
+		}
+		close(msgs)
+	}()
+
+	consumeOrders(context.Background(), context.Background(), msgs, make(chan struct{}, workers))
+	settled.Wait()
+
+	if peak > workers {
+		t.Errorf("%d orders processed at once, want at most %d", peak, workers)
+	}
+	if peak < 2 {
+		t.Errorf("orders were not processed concurrently, peak %d", peak)
+	}
+}
+
+// blockingSeenSet holds up orders until release is closed
+type blockingSeenSet struct {
+	started, release chan struct{}
+}
+
+func (s blockingSeenSet) Contains(context.Context, string) (bool, error) {
+	close(s.started)
+	<-s.release
+	return false, nil
+}
+
+func (blockingSeenSet) Add(context.Context, string) error { return nil }
+
+func TestConsumeOrdersFinishesAfterStop(t *testing.T) {
+	prevSeen := seenOrders
+	t.Cleanup(func() { seenOrders = prevSeen })
+	seen := blockingSeenSet{started: make(chan struct{}), release: make(chan struct{})}
+	seenOrders = seen
+
+	ctx, cancel := context.WithCancel(context.Background())
+	msgs := make(chan Delivery)
+	settled := make(chan error, 1)
+	consumed := make(chan struct{})
+	go func() {
+		consumeOrders(ctx, context.WithoutCancel(ctx), msgs, make(chan struct{}, 1))
+		close(consumed)
+	}()
+	msgs <- Delivery{
+		Headers: propagation.MapCarrier{},
+		Body:    orderBody(uniqueID(t)),
+		settle:  func(err error) { settled <- err },
+	}
+
+	// stop consuming with the order still being processed
+	<-seen.started
+	cancel()
+	<-consumed
+	close(seen.release)
+
+	select {
+	case err := <-settled:
+		if err != nil {
+			t.Errorf("order settled with %v, want it processed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("order not settled")
+	}
+}
+
+// panickingSeenSet panics when asked about an order
+type panickingSeenSet struct{}
+
+func (panickingSeenSet) Contains(context.Context, string) (bool, error) {
+	panic("seen set unavailable")
+}
+
+func (panickingSeenSet) Add(context.Context, string) error {
+	panic("seen set unavailable")
+}
+
+func TestConsumeOrdersRecoversPanics(t *testing.T) {
+	spans := recordSpans(t)
+	prevLimiter, prevSeen := orderLimiter, seenOrders
+	t.Cleanup(func() { orderLimiter, seenOrders = prevLimiter, prevSeen })
+
+	msgs := make(chan Delivery)
+	consumed := make(chan struct{})
+	go func() {
+		consumeOrders(context.Background(), context.Background(), msgs, make(chan struct{}, 1))
+		close(consumed)
+	}()
+	settled := make(chan error)
+	process := func(settle func(error)) error {
+		t.Helper()
+		msgs <- Delivery{Headers: propagation.MapCarrier{}, Body: orderBody(uniqueID(t)), settle: settle}
+		select {
+		case err := <-settled:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("order not settled")
+			return nil
+		}
+	}
+	settle := func(err error) { settled <- err }
+
+	// before the span is started
+	orderLimiter = nil
+	if err := process(settle); classify(err) != dispositionDeadLetter {
+		t.Errorf("panic in the limiter settled with %v, want it dead lettered", err)
+	}
+	orderLimiter = prevLimiter
+
+	// while processing, which fails the span
+	seenOrders = panickingSeenSet{}
+	if err := process(settle); classify(err) != dispositionDeadLetter {
+		t.Errorf("panic processing settled with %v, want it dead lettered", err)
+	}
+	seenOrders = prevSeen
+	if span := findSpan(t, spans, "getOrder"); span.Status.Code != codes.Error {
+		t.Errorf("getOrder status %v after a panic, want error", span.Status.Code)
+	}
+
+	// while settling, after which the next order is still processed
+	msgs <- Delivery{Headers: propagation.MapCarrier{}, Body: orderBody(uniqueID(t)), settle: func(error) {
+		panic("settle failed")
+	}}
+	if err := process(settle); err != nil {
+		t.Errorf("order after a panic settling failed: %v", err)
+	}
+
+	close(msgs)
+	<-consumed
+	inflight.Wait()
+}
+
+func TestGetOrderId(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"string", `{"orderid":"abc-1"}`, "abc-1"},
+		{"numeric orderid", `{"orderid":42}`, "42"},
+		{"missing orderid", `{"user":"test"}`, "unknown"},
+		{"array", `[{"orderid":"abc-1"}]`, "unknown"},
+		{"number", `42`, "unknown"},
+		{"not json", `orderid`, "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getOrderId([]byte(tt.body), "application/json", ""); got != tt.want {
+				t.Errorf("getOrderId(%s) = %q, want %q", tt.body, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTraceExporterHTTP(t *testing.T) {
+	paths := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case paths <- r.URL.Path:
+		default:
+		}
+	}))
+	defer srv.Close()
+
+	t.Setenv("OTEL_EXPORTER_OTLP_PROTOCOL", "http/protobuf")
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", srv.URL)
+
+	otlp, err := loadOTLPConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	exporter, err := newTraceExporter(ctx, otlp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exporter.Shutdown(ctx)
+
+	spans := tracetest.SpanStubs{{Name: "getOrder"}}.Snapshots()
+	if err := exporter.ExportSpans(ctx, spans); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case path := <-paths:
+		if path != "/v1/traces" {
+			t.Errorf("exported to %s, want /v1/traces", path)
+		}
+	default:
+		t.Error("nothing exported over HTTP")
+	}
+}
+
+func TestAmqpURIEscapesCredentials(t *testing.T) {
+	uri := amqpURI("amqp", "dispatch", "p@ss/w:rd", "rabbitmq", "5672", "/")
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		t.Fatalf("amqpURI returned %q: %v", uri, err)
+	}
+	if password, _ := u.User.Password(); password != "p@ss/w:rd" {
+		t.Errorf("password %q, want p@ss/w:rd", password)
+	}
+	if u.User.Username() != "dispatch" {
+		t.Errorf("user %q, want dispatch", u.User.Username())
+	}
+	if u.Host != "rabbitmq:5672" {
+		t.Errorf("host %q, want rabbitmq:5672", u.Host)
+	}
+	if u.Path != "/" {
+		t.Errorf("vhost path %q, want /", u.Path)
+	}
+
+	if _, err := amqp.ParseURI(uri); err != nil {
+		t.Errorf("amqp cannot parse %q: %v", uri, err)
+	}
+}
+
+func TestCreateSpanTimeout(t *testing.T) {
+	prevTimeout, prevLatency := orderTimeout, latencyBase
+	t.Cleanup(func() { orderTimeout, latencyBase = prevTimeout, prevLatency })
+	orderTimeout, latencyBase = time.Millisecond, 50
+	spans := recordSpans(t)
+
+	err := createSpan(context.Background(), Delivery{
+		Headers: propagation.MapCarrier{},
+		Body:    orderBody(uniqueID(t)),
+	})
+	if !errors.Is(err, errTransient) || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("createSpan error %v, want a transient timeout", err)
+	}
+
+	if span := findSpan(t, spans, "getOrder"); span.Status.Code != codes.Error {
+		t.Errorf("span status %v, want error", span.Status.Code)
+	}
+}
+
+func TestDeclareTopologyBindsEveryRoutingKey(t *testing.T) {
+	prevQueue, prevKeys := queueName, routingKeys
+	t.Cleanup(func() { queueName, routingKeys = prevQueue, prevKeys })
+	queueName, routingKeys = "orders", []string{"orders.eu", "orders.us", "orders"}
+
+	ch := newFakeChannel()
+	if err := declareTopology(ch); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := ch.boundKeys("orders", exchangeName); !slices.Equal(got, routingKeys) {
+		t.Errorf("orders bound with %v, want %v", got, routingKeys)
+	}
+}
+
+func TestDeclareTopology(t *testing.T) {
+	prevPrefetch := prefetch
+	t.Cleanup(func() { prefetch = prevPrefetch })
+	prefetch = 25
+
+	ch := newFakeChannel()
+	if err := declareTopology(ch); err != nil {
+		t.Fatal(err)
+	}
+
+	if ch.prefetch != 25 {
+		t.Errorf("prefetch %d, want 25", ch.prefetch)
+	}
+	wantExchanges := map[string]string{exchangeName: exchangeType, deadLetterExchange: exchangeType}
+	for name, kind := range wantExchanges {
+		if got, ok := ch.exchanges[name]; !ok || got != kind {
+			t.Errorf("exchange %s declared as %q, want %q", name, got, kind)
+		}
+	}
+	for _, queue := range []string{"orders", "orders.retry", deadLetterQueue} {
+		if _, ok := ch.queues[queue]; !ok {
+			t.Errorf("queue %s not declared", queue)
+		}
+	}
+	if got := ch.queues["orders.retry"]["x-dead-letter-exchange"]; got != exchangeName {
+		t.Errorf("retry queue dead letters to %v, want %s", got, exchangeName)
+	}
+	if got := ch.boundKeys(deadLetterQueue, deadLetterExchange); !slices.Equal(got, routingKeys) {
+		t.Errorf("dead letter queue bound with %v, want %v", got, routingKeys)
+	}
+}
+
+func TestDeclareTopologyClosedChannel(t *testing.T) {
+	ch := newFakeChannel()
+	ch.Close()
+
+	if err := declareTopology(ch); !errors.Is(err, amqp.ErrClosed) {
+		t.Errorf("declaring on a closed channel returned %v, want %v", err, amqp.ErrClosed)
+	}
+}
+
+func TestOpenConsumerClosesChannelOnFailure(t *testing.T) {
+	t.Cleanup(func() { rabbitChan = nil })
+
+	conn := &fakeConnection{declareErr: errors.New("invalid exchange type")}
+	if _, err := openConsumer(conn); err == nil {
+		t.Fatal("topology failure not returned")
+	}
+	if ch := conn.channel(0); !ch.closed {
+		t.Error("consumer channel left open after the topology failed")
+	}
+}
+
+func TestAcknowledgeDropsUnparseable(t *testing.T) {
+	body := []byte(`{"orderid": "abc-1", "cart": `)
+	err := createSpan(context.Background(), Delivery{Headers: propagation.MapCarrier{}, Body: body})
+	if classify(err) != dispositionDrop {
+		t.Fatalf("unparseable order classified %s, want drop", classify(err))
+	}
+
+	ack := &fakeAcknowledger{}
+	acknowledge(amqp.Delivery{Acknowledger: ack, Body: body}, "", err)
+	if got := ack.last(); got != "ack" {
+		t.Errorf("unparseable order settled with %q, want ack", got)
+	}
+}
+
+func TestAcknowledgeRequeuesTransient(t *testing.T) {
+	err := transient(errors.New("Failed to dispatch to SOP"))
+	if classify(err) != dispositionRetry {
+		t.Fatalf("transient failure classified %s, want retry", classify(err))
+	}
+
+	// without a publish channel the retry cannot be queued, so the order
+	// goes straight back to the broker
+	ack := &fakeAcknowledger{}
+	acknowledge(amqp.Delivery{Acknowledger: ack, Body: orderBody("abc-1")}, "", err)
+	if got := ack.last(); got != "nack requeue" {
+		t.Errorf("transient failure settled with %q, want nack requeue", got)
+	}
+}
+
+func TestCreateSpanSemconv(t *testing.T) {
+	spans := recordSpans(t)
+
+	err := createSpan(context.Background(), Delivery{
+		MessageID: "msg-1",
+		Headers:   propagation.MapCarrier{},
+		Body:      orderBody(uniqueID(t)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attrs := spanAttrs(findSpan(t, spans, "getOrder"))
+	want := map[attribute.Key]string{
+		"messaging.destination.name": exchangeName,
+		"messaging.operation.type":   "process",
+		"messaging.message.id":       "msg-1",
+		"messaging.destination":      exchangeName,
+		"messaging.destination_kind": "queue",
+		"messaging.operation":        "process",
+	}
+	for key, value := range want {
+		if got, ok := attrs[key]; !ok || got.AsString() != value {
+			t.Errorf("%s = %q, want %q", key, got.AsString(), value)
+		}
+	}
+}
+
+func TestCreateSpanRateLimit(t *testing.T) {
+	const perSecond = 50
+	prev := orderLimiter
+	t.Cleanup(func() { orderLimiter = prev })
+	orderLimiter = rate.NewLimiter(perSecond, 1)
+
+	const orders = 11
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range orders {
+		wg.Go(func() {
+			if err := createSpan(context.Background(), Delivery{Headers: propagation.MapCarrier{}, Body: orderBody(uniqueID(t))}); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	wg.Wait()
+
+	// the first order takes the token in the bucket, the rest wait their turn
+	elapsed := time.Since(start)
+	if throughput := float64(orders-1) / elapsed.Seconds(); throughput > perSecond*1.1 {
+		t.Errorf("processed %.0f orders a second, want at most %d", throughput, perSecond)
+	}
+}
+
+func TestQueueArgs(t *testing.T) {
+	prevType, prevTTL, prevLength := queueType, queueTTL, queueMaxLength
+	t.Cleanup(func() { queueType, queueTTL, queueMaxLength = prevType, prevTTL, prevLength })
+
+	queueType, queueTTL, queueMaxLength = "classic", 0, 0
+	if args := queueArgs(); len(args) != 0 {
+		t.Errorf("classic queue args %v, want none", args)
+	}
+
+	queueType, queueTTL, queueMaxLength = "classic", 30*time.Second, 1000
+	args := queueArgs()
+	if _, ok := args["x-queue-type"]; ok {
+		t.Error("x-queue-type set for a classic queue")
+	}
+	if args["x-message-ttl"] != int64(30000) {
+		t.Errorf("x-message-ttl = %#v, want int64 30000", args["x-message-ttl"])
+	}
+	if args["x-max-length"] != int64(1000) {
+		t.Errorf("x-max-length = %#v, want int64 1000", args["x-max-length"])
+	}
+
+	queueType, queueTTL, queueMaxLength = "quorum", 0, 0
+	if args := queueArgs(); args["x-queue-type"] != "quorum" {
+		t.Errorf("x-queue-type = %#v, want quorum", args["x-queue-type"])
+	}
+}
+
+func TestDeclareTopologyMaxPriority(t *testing.T) {
+	prev := queueMaxPriority
+	t.Cleanup(func() { queueMaxPriority = prev })
+	queueMaxPriority = 10
+
+	ch := newFakeChannel()
+	if err := declareTopology(ch); err != nil {
+		t.Fatal(err)
+	}
+
+	args := ch.queues[queueName]
+	if args["x-max-priority"] != int64(10) {
+		t.Errorf("queue declared with x-max-priority %#v, want int64 10", args["x-max-priority"])
+	}
+	if err := args.Validate(); err != nil {
+		t.Errorf("queue declare args invalid: %v", err)
+	}
+}
+
+func TestCreateSpanFailPattern(t *testing.T) {
+	prev := failPattern
+	t.Cleanup(func() { failPattern = prev })
+	failPattern = regexp.MustCompile(`^chaos-`)
+
+	err := createSpan(context.Background(), Delivery{Headers: propagation.MapCarrier{}, Body: orderBody("chaos-" + uniqueID(t))})
+	if !errors.Is(err, errTransient) || !strings.Contains(err.Error(), "matches") {
+		t.Errorf("matching order error %v, want a transient failure", err)
+	}
+
+	err = createSpan(context.Background(), Delivery{Headers: propagation.MapCarrier{}, Body: orderBody("calm-" + uniqueID(t))})
+	if err != nil {
+		t.Errorf("non-matching order failed: %v", err)
+	}
+}
+
+func TestCreateSpanOversized(t *testing.T) {
+	prevMax, prevAck := maxBodyBytes, manualAck
+	t.Cleanup(func() { maxBodyBytes, manualAck = prevMax, prevAck })
+	maxBodyBytes, manualAck = 64, true
+	spans := recordSpans(t)
+
+	ack := &fakeAcknowledger{}
+	d := amqpDelivery(amqp.Delivery{Acknowledger: ack, Body: orderBody(uniqueID(t))}, "")
+	err := createSpan(context.Background(), d)
+	if !errors.Is(err, errOversized) || classify(err) != dispositionDeadLetter {
+		t.Fatalf("oversized order error %v, want errOversized to dead letter", err)
+	}
+
+	var event bool
+	for _, e := range findSpan(t, spans, "getOrder").Events {
+		event = event || e.Name == "oversized_message"
+	}
+	if !event {
+		t.Error("no oversized_message event")
+	}
+
+	d.Settle(err)
+	if got := ack.last(); got != "reject" {
+		t.Errorf("oversized order settled with %q, want reject", got)
+	}
+}
+
+func TestDowntimeSince(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	prev := downtimeClock
+	t.Cleanup(func() { downtimeClock = prev })
+	downtimeClock = func() time.Time { return now }
+
+	tests := []struct {
+		since time.Time
+		want  time.Duration
+	}{
+		{now, 0},
+		{now.Add(-3 * time.Second), 3 * time.Second},
+		{now.Add(-90 * time.Minute), 90 * time.Minute},
+		// the wall clock was stepped back during the outage
+		{now.Add(time.Second), 0},
+	}
+	for _, tt := range tests {
+		if got := downtimeSince(tt.since); got != tt.want {
+			t.Errorf("downtimeSince(%s) = %s, want %s", tt.since.Format(time.TimeOnly), got, tt.want)
+		}
+	}
+}
+
+func TestRecordDowntimeSpan(t *testing.T) {
+	spans := recordSpans(t)
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	prev := downtimeClock
+	t.Cleanup(func() { downtimeClock = prev })
+	downtimeClock = func() time.Time { return now }
+
+	since := now.Add(-4 * time.Second)
+	recordDowntime(since, &amqp.Error{Code: amqp.ConnectionForced, Reason: "CONNECTION_FORCED"})
+
+	span := findSpan(t, spans, "rabbitmqDowntime")
+	if !span.StartTime.Equal(since) || !span.EndTime.Equal(now) {
+		t.Errorf("downtime span from %s to %s, want %s to %s", span.StartTime, span.EndTime, since, now)
+	}
+	if got := spanAttrs(span)["rabbitmq.downtime_ms"].AsInt64(); got != 4000 {
+		t.Errorf("rabbitmq.downtime_ms = %d, want 4000", got)
+	}
+}
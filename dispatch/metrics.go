@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/exemplar"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// orders currently being processed by createSpan
+var inflightOrders atomic.Int64
+
+var (
+	ordersProcessed    metric.Int64Counter
+	ordersErrors       metric.Int64Counter
+	rabbitReconnects   metric.Int64Counter
+	unroutable         metric.Int64Counter
+	processingDuration metric.Float64Histogram
+	messageAge         metric.Float64Histogram
+	rabbitDowntime     metric.Float64Histogram
+)
+
+func newMetricExporter(ctx context.Context, cfg *otlpConfig) (sdkmetric.Exporter, error) {
+	if cfg.protocol == "http/protobuf" {
+		var opts []otlpmetrichttp.Option
+		if cfg.endpoint != "" {
+			opts = append(opts, otlpmetrichttp.WithEndpointURL(signalURL(cfg.endpoint, "/v1/metrics")))
+		}
+		if len(cfg.headers) > 0 {
+			opts = append(opts, otlpmetrichttp.WithHeaders(cfg.headers))
+		}
+		if cfg.tls != nil {
+			opts = append(opts, otlpmetrichttp.WithTLSClientConfig(cfg.tls))
+		} else if cfg.insecure() {
+			opts = append(opts, otlpmetrichttp.WithInsecure())
+		}
+		return otlpmetrichttp.New(ctx, opts...)
+	}
+
+	var opts []otlpmetricgrpc.Option
+	if cfg.endpoint != "" {
+		opts = append(opts, otlpmetricgrpc.WithEndpointURL(cfg.endpoint))
+	}
+	if len(cfg.headers) > 0 {
+		opts = append(opts, otlpmetricgrpc.WithHeaders(cfg.headers))
+	}
+	if cfg.tls != nil {
+		opts = append(opts, otlpmetricgrpc.WithTLSCredentials(credentials.NewTLS(cfg.tls)))
+	} else if cfg.insecure() {
+		opts = append(opts, otlpmetricgrpc.WithInsecure())
+	}
+	return otlpmetricgrpc.New(ctx, opts...)
+}
+
+func initMeter(otlp *otlpConfig) *sdkmetric.MeterProvider {
+	ctx := context.Background()
+
+	exporter, err := newMetricExporter(ctx, otlp)
+	if err != nil {
+		fatal("Failed to create metric exporter", "error", err)
+	}
+
+	opts := []sdkmetric.Option{
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter)),
+		sdkmetric.WithResource(serviceResource()),
+	}
+	// attach the sampled span a measurement was made in as an exemplar,
+	// unless OTEL_METRICS_EXEMPLAR_FILTER says otherwise
+	if _, ok := os.LookupEnv("OTEL_METRICS_EXEMPLAR_FILTER"); !ok {
+		opts = append(opts, sdkmetric.WithExemplarFilter(exemplar.TraceBasedFilter))
+	}
+	mp := sdkmetric.NewMeterProvider(opts...)
+
+	otel.SetMeterProvider(mp)
+	initInstruments(mp.Meter("dispatch-service"))
+
+	return mp
+}
+
+// initInstruments creates the instruments orders are measured with on meter
+func initInstruments(meter metric.Meter) {
+	var err error
+	ordersProcessed, err = meter.Int64Counter("dispatch.orders.processed",
+		metric.WithDescription("Orders processed"))
+	failOnError(err, "Failed to create processed counter")
+
+	ordersErrors, err = meter.Int64Counter("dispatch.orders.errors",
+		metric.WithDescription("Orders that failed processing"))
+	failOnError(err, "Failed to create error counter")
+
+	rabbitReconnects, err = meter.Int64Counter("dispatch.rabbitmq.reconnects",
+		metric.WithDescription("Reconnections to RabbitMQ after the connection was lost"))
+	failOnError(err, "Failed to create reconnect counter")
+
+	unroutable, err = meter.Int64Counter("dispatch.publish.unroutable",
+		metric.WithDescription("Messages returned by the broker as unroutable"))
+	failOnError(err, "Failed to create unroutable counter")
+
+	processingDuration, err = meter.Float64Histogram("dispatch.processing.duration_ms",
+		metric.WithDescription("Time taken to process an order"),
+		metric.WithUnit("ms"))
+	failOnError(err, "Failed to create duration histogram")
+
+	messageAge, err = meter.Float64Histogram("dispatch.message.age_ms",
+		metric.WithDescription("Time an order waited in the queue before it was consumed"),
+		metric.WithUnit("ms"))
+	failOnError(err, "Failed to create message age histogram")
+
+	rabbitDowntime, err = meter.Float64Histogram("dispatch.rabbitmq.downtime_ms",
+		metric.WithDescription("Time from losing the connection to RabbitMQ until consuming again"),
+		metric.WithUnit("ms"))
+	failOnError(err, "Failed to create downtime histogram")
+
+	_, err = meter.Int64ObservableGauge("dispatch.inflight",
+		metric.WithDescription("Orders being processed"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			o.Observe(inflightOrders.Load())
+			return nil
+		}))
+	failOnError(err, "Failed to create in-flight gauge")
+
+	_, err = meter.Int64ObservableGauge("dispatch.queue.depth",
+		metric.WithDescription("Messages ready in the orders queue"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			for name, n := range queueDepthSnapshot() {
+				o.Observe(int64(n), metric.WithAttributes(attribute.String("queue", name)))
+			}
+			return nil
+		}))
+	failOnError(err, "Failed to create queue depth gauge")
+}
+
+// recordOrder records the outcome of processing one order. The duration
+// carries the trace of the span in ctx as an exemplar, exported over OTLP to
+// backends such as Grafana Mimir, Tempo and Elastic and on /metrics in the
+// OpenMetrics format for Prometheus with exemplar storage enabled
+func recordOrder(ctx context.Context, dataCenter string, start time.Time, err error) {
+	attrs := metric.WithAttributes(attribute.String("datacenter", dataCenter))
+
+	elapsed := time.Since(start)
+
+	ordersProcessed.Add(ctx, 1, attrs)
+	promProcessed.Inc()
+	if err != nil {
+		ordersErrors.Add(ctx, 1, attrs)
+		promErrors.Inc()
+	}
+	processingDuration.Record(ctx, float64(elapsed)/float64(time.Millisecond), attrs)
+	if sc := trace.SpanContextFromContext(ctx); sc.IsSampled() {
+		promLatency.(prometheus.ExemplarObserver).ObserveWithExemplar(elapsed.Seconds(),
+			prometheus.Labels{"trace_id": sc.TraceID().String()})
+	} else {
+		promLatency.Observe(elapsed.Seconds())
+	}
+}
+
+// recordMessageAge records how long an order published at published waited
+// before it was consumed, returning the age. Orders without a timestamp are
+// not recorded, those stamped in the future by a skewed clock count as 0
+func recordMessageAge(ctx context.Context, published, consumed time.Time) (time.Duration, bool) {
+	if published.IsZero() {
+		return 0, false
+	}
+	age := max(consumed.Sub(published), 0)
+
+	messageAge.Record(ctx, float64(age)/float64(time.Millisecond))
+	promMessageAge.Observe(age.Seconds())
+
+	return age, true
+}
+
+// recordReconnect counts a reconnection to RabbitMQ
+func recordReconnect(ctx context.Context) {
+	rabbitReconnects.Add(ctx, 1)
+	promReconnects.Inc()
+}
+
+// recordDowntimeMetric records how long the connection to RabbitMQ was down
+func recordDowntimeMetric(ctx context.Context, downtime time.Duration) {
+	rabbitDowntime.Record(ctx, float64(downtime)/float64(time.Millisecond))
+	promDowntime.Observe(downtime.Seconds())
+}
+
+// recordUnroutable counts a message returned as unroutable
+func recordUnroutable(ctx context.Context, exchange string, key string) {
+	unroutable.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("exchange", exchange),
+		attribute.String("routing_key", key),
+	))
+	promUnroutable.Inc()
+}
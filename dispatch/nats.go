@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// natsBroker consumes orders from NATS JetStream. Each exchange maps to a
+// stream of the same name holding the subjects <exchange>.<routing key>, and
+// the queue to a durable consumer
+type natsBroker struct {
+	url string
+
+	mu sync.Mutex
+	nc *nats.Conn
+	js jetstream.JetStream
+}
+
+func newNATSBroker(url string) *natsBroker {
+	return &natsBroker{url: url}
+}
+
+func (b *natsBroker) System() string {
+	return "nats"
+}
+
+func (b *natsBroker) Consume(ctx context.Context) (<-chan Delivery, error) {
+	out := make(chan Delivery)
+	go func() {
+		if err := b.connect(ctx); err != nil {
+			return
+		}
+
+		tenantConsumers, err := b.setup(ctx)
+		failOnError(err, "Failed to set up JetStream")
+
+		// a consumer for each tenant so one tenant's backlog cannot hold
+		// up the others
+		var consuming []jetstream.ConsumeContext
+		for tenant, consumer := range tenantConsumers {
+			for range consumers {
+				cc, err := consumer.Consume(func(msg jetstream.Msg) {
+					select {
+					case <-ctx.Done():
+					case out <- natsDelivery(msg, tenant):
+					}
+				}, jetstream.PullMaxMessages(prefetch))
+				failOnError(err, "Failed to consume")
+				consuming = append(consuming, cc)
+			}
+		}
+		setConnected(true)
+
+		<-ctx.Done()
+		for _, cc := range consuming {
+			cc.Stop()
+		}
+	}()
+
+	return out, nil
+}
+
+// natsMaxReconnects is the reconnect limit of the NATS client, which takes
+// -1 for no limit
+func natsMaxReconnects() int {
+	if maxReconnects == 0 {
+		return -1
+	}
+
+	return maxReconnects
+}
+
+// connect dials NATS until it succeeds or ctx is done, the client then
+// reconnects by itself
+func (b *natsBroker) connect(ctx context.Context) error {
+	for attempt := 1; ; attempt++ {
+		slog.Info("Connecting to NATS", "url", redactURI(b.url))
+		nc, err := nats.Connect(b.url,
+			nats.Name(consumerTag),
+			nats.MaxReconnects(natsMaxReconnects()),
+			nats.ReconnectWait(reconnectBase),
+			nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+				slog.Warn("Disconnected from NATS", "error", err)
+				setConnected(false)
+			}),
+			nats.ReconnectHandler(func(nc *nats.Conn) {
+				slog.Info("Reconnected to NATS", "url", nc.ConnectedUrlRedacted())
+				recordReconnect(context.Background())
+				setConnected(true)
+			}),
+			// only closed for good once the reconnects run out
+			nats.ClosedHandler(func(nc *nats.Conn) {
+				if maxReconnects > 0 && ctx.Err() == nil {
+					fatal("Giving up reconnecting to NATS", "url", redactURI(b.url), "attempts", maxReconnects, "error", nc.LastError())
+				}
+			}),
+		)
+		if err == nil {
+			b.mu.Lock()
+			b.nc = nc
+			b.mu.Unlock()
+			slog.Info("Connected to NATS")
+			return nil
+		}
+
+		slog.Error("Failed to connect to NATS", "error", err)
+		if maxReconnects > 0 && attempt >= maxReconnects {
+			fatal("Giving up connecting to NATS", "url", redactURI(b.url), "attempts", attempt, "error", err)
+		}
+		delay := backoffDelay(attempt, reconnectBase, reconnectMax)
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// setup declares the streams and a durable consumer for the orders of each
+// tenant, keyed by tenant
+func (b *natsBroker) setup(ctx context.Context) (map[string]jetstream.Consumer, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	js, err := jetstream.New(b.nc)
+	if err != nil {
+		return nil, err
+	}
+
+	streams := append([]string{exchangeName}, confirmExchanges()...)
+	for _, name := range streams {
+		_, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+			Name:     name,
+			Subjects: []string{name + ".>"},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("creating stream %s: %w", name, err)
+		}
+	}
+
+	tenantConsumers := make(map[string]jetstream.Consumer)
+	for _, tenant := range consumedTenants() {
+		keys := tenantKeys(tenant)
+		subjects := make([]string, 0, len(keys))
+		for _, key := range keys {
+			subjects = append(subjects, exchangeName+"."+key)
+		}
+
+		// durable names cannot contain dots
+		durable := strings.ReplaceAll(tenantQueue(tenant), ".", "-")
+		consumer, err := js.CreateOrUpdateConsumer(ctx, exchangeName, jetstream.ConsumerConfig{
+			Durable:        durable,
+			AckPolicy:      jetstream.AckExplicitPolicy,
+			FilterSubjects: subjects,
+			MaxAckPending:  prefetch,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("creating consumer %s: %w", durable, err)
+		}
+		tenantConsumers[tenant] = consumer
+	}
+	b.js = js
+
+	return tenantConsumers, nil
+}
+
+func natsDelivery(msg jetstream.Msg, tenant string) Delivery {
+	d := Delivery{
+		MessageID: msg.Headers().Get(jetstream.MsgIDHeader),
+		Headers:   propagation.HeaderCarrier(msg.Headers()),
+		Body:      msg.Data(),
+		Tenant:    tenant,
+
+		ContentType:     msg.Headers().Get("Content-Type"),
+		ContentEncoding: msg.Headers().Get("Content-Encoding"),
+		CorrelationID:   msg.Headers().Get(correlationHeader),
+	}
+	if meta, err := msg.Metadata(); err == nil {
+		if meta.NumDelivered > 0 {
+			d.Redeliveries = int64(meta.NumDelivered - 1)
+		}
+		// stored in the stream as soon as it was published
+		d.Timestamp = meta.Timestamp
+	}
+
+	if !manualAck {
+		if err := msg.Ack(); err != nil {
+			slog.Error("Failed to ack message", "error", err)
+		}
+		return d
+	}
+	d.settle = func(err error) {
+		settleNATS(msg, err)
+	}
+
+	return d
+}
+
+// settleNATS acknowledges msg the way acknowledge does for AMQP. Invalid
+// orders and permanent failures are dropped, orders skipped by the open SOP
+// circuit are redelivered straight away and other failed orders are
+// redelivered after retryDelay until they have failed maxRetries times.
+// JetStream has no dead letter queue so those are then dropped too
+func settleNATS(msg jetstream.Msg, err error) {
+	var settleErr error
+	switch classify(err) {
+	case dispositionAck:
+		settleErr = msg.Ack()
+	case dispositionDrop:
+		slog.Warn("Dropping invalid order", "orderid", getOrderId(msg.Data(), msg.Headers().Get("Content-Type"), msg.Headers().Get("Content-Encoding")), "error", err)
+		settleErr = msg.Term()
+	case dispositionDeadLetter:
+		slog.Warn("Dropping order", "body_bytes", len(msg.Data()), "error", err)
+		settleErr = msg.Term()
+	case dispositionRequeue:
+		settleErr = msg.Nak()
+	case dispositionRetry:
+		meta, metaErr := msg.Metadata()
+		if metaErr == nil && meta.NumDelivered > uint64(maxRetries) {
+			slog.Warn("Dropping order after retries", "retries", meta.NumDelivered-1, "error", err)
+			settleErr = msg.Term()
+		} else {
+			slog.Warn("Retrying order", "error", err)
+			settleErr = msg.NakWithDelay(retryDelay)
+		}
+	}
+
+	if settleErr != nil {
+		slog.Error("Failed to acknowledge message", "error", settleErr)
+	}
+}
+
+func (b *natsBroker) Publish(ctx context.Context, exchange string, key string, body []byte) error {
+	b.mu.Lock()
+	js := b.js
+	b.mu.Unlock()
+
+	if js == nil {
+		return fmt.Errorf("not connected to NATS")
+	}
+
+	msg := nats.NewMsg(exchange + "." + key)
+	msg.Data = body
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(msg.Header))
+	if id := correlationID(ctx); id != "" {
+		msg.Header.Set(correlationHeader, id)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, confirmTimeout)
+	defer cancel()
+
+	_, err := js.PublishMsg(ctx, msg)
+
+	return err
+}
+
+func (b *natsBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.nc != nil {
+		b.nc.Close()
+	}
+
+	return nil
+}
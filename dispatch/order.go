@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/proto"
+
+	"dispatch/orderpb"
+)
+
+// the cart holds the shipping charge as an item named after the destination
+const (
+	shippingSKU    = "SHIP"
+	shippingPrefix = "shipping to "
+)
+
+// content type of orders encoded as orderpb.Order
+const protobufContentType = "application/x-protobuf"
+
+// errInvalidOrder marks order bodies that can never be processed
+var errInvalidOrder = errors.New("invalid order")
+
+// errOversized marks messages larger than DISPATCH_MAX_BODY_BYTES, which are
+// dead-lettered without being parsed
+var errOversized = permanent(errors.New("message too large"))
+
+// Item is a line of the cart that was paid for
+type Item struct {
+	SKU      string  `json:"sku"`
+	Name     string  `json:"name"`
+	Qty      int     `json:"qty"`
+	Price    float64 `json:"price"`
+	Subtotal float64 `json:"subtotal"`
+}
+
+// Order is a completed checkout queued by the payment service
+type Order struct {
+	OrderID     string
+	Type        string
+	User        string
+	Total       float64
+	Items       []Item
+	Destination string
+
+	// span the order was processed in
+	SpanContext trace.SpanContext
+}
+
+// ItemCount returns the number of products in the order, not counting the
+// shipping charge
+func (o *Order) ItemCount() int {
+	count := 0
+	for _, item := range o.Items {
+		if item.SKU != shippingSKU {
+			count += item.Qty
+		}
+	}
+
+	return count
+}
+
+// orderID is an order id that some producers send as a JSON number rather
+// than a string. Numbers are kept as written, ids too large for an int64 or
+// a float64 would otherwise lose digits
+type orderID string
+
+func (id *orderID) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*id = orderID(s)
+		return nil
+	}
+
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return fmt.Errorf("orderid is neither a string nor a number: %s", data)
+	}
+	*id = orderID(n.String())
+
+	return nil
+}
+
+// orderMessage is the order as published, with the cart nested inside
+type orderMessage struct {
+	OrderID orderID    `json:"orderid"`
+	Type    string     `json:"type"`
+	User    string     `json:"user"`
+	Cart    *orderCart `json:"cart"`
+}
+
+type orderCart struct {
+	Total float64 `json:"total"`
+	Items []Item  `json:"items"`
+}
+
+// isProtobuf reports whether contentType is that of protobuf encoded orders
+func isProtobuf(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == protobufContentType
+}
+
+// decodeOrder decodes an order message body sent as protobuf or, for any
+// other content type, as JSON
+func decodeOrder(body []byte, contentType string) (*orderMessage, error) {
+	if !isProtobuf(contentType) {
+		var msg orderMessage
+		if err := json.Unmarshal(body, &msg); err != nil {
+			return nil, err
+		}
+		return &msg, nil
+	}
+
+	var pb orderpb.Order
+	if err := proto.Unmarshal(body, &pb); err != nil {
+		return nil, err
+	}
+	msg := &orderMessage{
+		OrderID: orderID(pb.GetOrderid()),
+		Type:    pb.GetType(),
+		User:    pb.GetUser(),
+	}
+	if cart := pb.GetCart(); cart != nil {
+		msg.Cart = &orderCart{Total: cart.GetTotal()}
+		for _, item := range cart.GetItems() {
+			msg.Cart.Items = append(msg.Cart.Items, Item{
+				SKU:      item.GetSku(),
+				Name:     item.GetName(),
+				Qty:      int(item.GetQty()),
+				Price:    item.GetPrice(),
+				Subtotal: item.GetSubtotal(),
+			})
+		}
+	}
+
+	return msg, nil
+}
+
+// parseOrder decodes and validates an order message body of contentType
+func parseOrder(body []byte, contentType string) (*Order, error) {
+	// the schema describes the JSON form
+	if !isProtobuf(contentType) {
+		if err := validateOrder(body); err != nil {
+			return nil, err
+		}
+	}
+
+	msg, err := decodeOrder(body, contentType)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidOrder, err)
+	}
+
+	if msg.OrderID == "" {
+		return nil, fmt.Errorf("%w: missing orderid", errInvalidOrder)
+	}
+	if msg.Cart == nil {
+		return nil, fmt.Errorf("%w %s: missing cart", errInvalidOrder, msg.OrderID)
+	}
+	if len(msg.Cart.Items) == 0 {
+		return nil, fmt.Errorf("%w %s: no items", errInvalidOrder, msg.OrderID)
+	}
+	if msg.Cart.Total < 0 {
+		return nil, fmt.Errorf("%w %s: negative total", errInvalidOrder, msg.OrderID)
+	}
+	for i, item := range msg.Cart.Items {
+		if item.SKU == "" {
+			return nil, fmt.Errorf("%w %s: item %d has no sku", errInvalidOrder, msg.OrderID, i)
+		}
+		if item.Qty < 1 {
+			return nil, fmt.Errorf("%w %s: item %s has quantity %d", errInvalidOrder, msg.OrderID, item.SKU, item.Qty)
+		}
+	}
+
+	order := &Order{
+		OrderID: string(msg.OrderID),
+		Type:    msg.Type,
+		User:    msg.User,
+		Total:   msg.Cart.Total,
+		Items:   msg.Cart.Items,
+	}
+	for _, item := range msg.Cart.Items {
+		if item.SKU == shippingSKU {
+			order.Destination = strings.TrimPrefix(item.Name, shippingPrefix)
+		}
+	}
+
+	return order, nil
+}
+
+// span names of the known message types, the type comes from the producer
+// so it is not used in span names as it is
+var spanNames = map[string]string{
+	"order":        "getOrder",
+	"refund":       "getRefund",
+	"cancellation": "getCancellation",
+}
+
+// spanName returns the name of the span processing a message of msgType,
+// getOrder for untyped messages and types it does not know
+func spanName(msgType string) string {
+	if name, ok := spanNames[msgType]; ok {
+		return name
+	}
+
+	return "getOrder"
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParseOrder(t *testing.T) {
+	order, err := parseOrder([]byte(`{
+		"orderid": "abc-1",
+		"user": "alice",
+		"cart": {
+			"total": 25.5,
+			"items": [
+				{"sku": "RB1", "name": "Robot", "qty": 2, "price": 10, "subtotal": 20},
+				{"sku": "SHIP", "name": "shipping to France Paris", "qty": 1, "price": 5.5, "subtotal": 5.5}
+			]
+		}
+	}`), "application/json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.OrderID != "abc-1" || order.User != "alice" || order.Total != 25.5 {
+		t.Errorf("parsed %+v", order)
+	}
+	if order.Destination != "France Paris" {
+		t.Errorf("destination %q, want France Paris", order.Destination)
+	}
+	if n := order.ItemCount(); n != 2 {
+		t.Errorf("item count %d, want 2", n)
+	}
+}
+
+func TestParseOrderInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"not json", `not json`},
+		{"missing orderid", `{"cart":{"total":1,"items":[{"sku":"RB1","qty":1}]}}`},
+		{"missing cart", `{"orderid":"abc-1"}`},
+		{"no items", `{"orderid":"abc-1","cart":{"total":1,"items":[]}}`},
+		{"negative total", `{"orderid":"abc-1","cart":{"total":-1,"items":[{"sku":"RB1","qty":1}]}}`},
+		{"missing sku", `{"orderid":"abc-1","cart":{"total":1,"items":[{"qty":1}]}}`},
+		{"zero quantity", `{"orderid":"abc-1","cart":{"total":1,"items":[{"sku":"RB1","qty":0}]}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseOrder([]byte(tt.body), "application/json")
+			if !errors.Is(err, errInvalidOrder) {
+				t.Errorf("parseOrder(%s) error %v, want errInvalidOrder", tt.body, err)
+			}
+		})
+	}
+}
+
+func TestParseOrderUnknownFields(t *testing.T) {
+	body := `{"orderid":"abc-1","coupon":"SAVE10","cart":{"total":1,"currency":"EUR","items":[{"sku":"RB1","qty":1,"colour":"red"}]}}`
+	order, err := parseOrder([]byte(body), "application/json")
+	if err != nil {
+		t.Fatalf("unknown fields rejected: %v", err)
+	}
+	if order.OrderID != "abc-1" {
+		t.Errorf("order id %q, want abc-1", order.OrderID)
+	}
+}
+
+func TestOrderIDUnmarshal(t *testing.T) {
+	tests := []struct {
+		json string
+		want orderID
+	}{
+		{`"abc-1"`, "abc-1"},
+		{`"12345"`, "12345"},
+		{`42`, "42"},
+		{`-7`, "-7"},
+		{`12.5`, "12.5"},
+		{`98765432109876543210987654321`, "98765432109876543210987654321"},
+		{`9007199254740993`, "9007199254740993"},
+		{`null`, ""},
+	}
+	for _, tt := range tests {
+		var id orderID
+		if err := json.Unmarshal([]byte(tt.json), &id); err != nil {
+			t.Errorf("unmarshal %s: %v", tt.json, err)
+			continue
+		}
+		if id != tt.want {
+			t.Errorf("unmarshal %s = %q, want %q", tt.json, id, tt.want)
+		}
+	}
+
+	for _, invalid := range []string{`true`, `{}`, `["abc-1"]`} {
+		var id orderID
+		if err := json.Unmarshal([]byte(invalid), &id); err == nil {
+			t.Errorf("unmarshal %s = %q, want an error", invalid, id)
+		}
+	}
+}
+
+func TestSpanName(t *testing.T) {
+	tests := map[string]string{
+		"":             "getOrder",
+		"order":        "getOrder",
+		"refund":       "getRefund",
+		"cancellation": "getCancellation",
+		"Refund":       "getOrder",
+		"exchange":     "getOrder",
+		"évènement":    "getOrder",
+	}
+	for msgType, want := range tests {
+		if got := spanName(msgType); got != want {
+			t.Errorf("spanName(%q) = %s, want %s", msgType, got, want)
+		}
+	}
+}
@@ -0,0 +1,5 @@
+// Package orderpb holds the protobuf form of orders, sent by producers with
+// the application/x-protobuf content type
+package orderpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative order.proto
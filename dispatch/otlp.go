@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// otlpConfig is how the exporters reach the collector
+type otlpConfig struct {
+	endpoint string
+	protocol string
+	headers  map[string]string
+	tls      *tls.Config
+}
+
+// loadOTLPConfig reads the collector settings from the standard OTLP
+// environment variables, defaulting to grpc without headers or TLS
+func loadOTLPConfig() (*otlpConfig, error) {
+	cfg := &otlpConfig{
+		endpoint: os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"),
+		protocol: getEnv("OTEL_EXPORTER_OTLP_PROTOCOL", "grpc"),
+	}
+	if cfg.protocol == "" {
+		cfg.protocol = "grpc"
+	}
+	if cfg.protocol != "grpc" && cfg.protocol != "http/protobuf" {
+		return nil, fmt.Errorf("unsupported OTLP protocol %q", cfg.protocol)
+	}
+
+	headers, err := parseHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"))
+	if err != nil {
+		return nil, err
+	}
+	cfg.headers = headers
+
+	caFile := os.Getenv("OTEL_EXPORTER_OTLP_CERTIFICATE")
+	certFile := os.Getenv("OTEL_EXPORTER_OTLP_CLIENT_CERTIFICATE")
+	keyFile := os.Getenv("OTEL_EXPORTER_OTLP_CLIENT_KEY")
+	if caFile != "" || certFile != "" || keyFile != "" {
+		cfg.tls, err = loadTLSConfig(caFile, certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("OTLP TLS: %w", err)
+		}
+	}
+
+	return cfg, nil
+}
+
+// insecure reports whether to export in plain text, which is the case unless
+// TLS files are configured or the endpoint is https
+func (c *otlpConfig) insecure() bool {
+	return c.tls == nil && !strings.HasPrefix(c.endpoint, "https://")
+}
+
+// parseHeaders parses the OTLP headers in list
+func parseHeaders(list string) (map[string]string, error) {
+	return parseKeyValues(list, "OTLP header")
+}
+
+// parseKeyValues parses a list of key=value pairs separated by commas, with
+// URL encoded values, naming what the pairs are in errors
+func parseKeyValues(list string, what string) (map[string]string, error) {
+	pairs := map[string]string{}
+	for _, pair := range splitList(list) {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("invalid %s %q", what, pair)
+		}
+		value, err := url.QueryUnescape(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %w", what, pair, err)
+		}
+		pairs[strings.TrimSpace(key)] = value
+	}
+
+	return pairs, nil
+}
+
+// parseResourceAttributes parses OTEL_RESOURCE_ATTRIBUTES into string
+// attributes sorted by key
+func parseResourceAttributes(list string) ([]attribute.KeyValue, error) {
+	pairs, err := parseKeyValues(list, "resource attribute")
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := make([]attribute.KeyValue, 0, len(pairs))
+	for key, value := range pairs {
+		attrs = append(attrs, attribute.String(key, value))
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].Key < attrs[j].Key })
+
+	return attrs, nil
+}
+
+// signalURL appends the per signal path to an OTLP/HTTP base endpoint
+func signalURL(endpoint string, path string) string {
+	return strings.TrimSuffix(endpoint, "/") + path
+}
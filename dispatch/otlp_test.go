@@ -0,0 +1,45 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+func TestParseResourceAttributes(t *testing.T) {
+	tests := []struct {
+		list string
+		want []attribute.KeyValue
+	}{
+		{"", []attribute.KeyValue{}},
+		{"deployment.environment=prod", []attribute.KeyValue{attribute.String("deployment.environment", "prod")}},
+		{
+			" service.version = 1.2.3 , deployment.environment=prod,team=robot%20shop",
+			[]attribute.KeyValue{
+				attribute.String("deployment.environment", "prod"),
+				attribute.String("service.version", "1.2.3"),
+				attribute.String("team", "robot shop"),
+			},
+		},
+		{"k8s.pod.name=", []attribute.KeyValue{attribute.String("k8s.pod.name", "")}},
+	}
+	for _, tt := range tests {
+		got, err := parseResourceAttributes(tt.list)
+		if err != nil {
+			t.Errorf("parseResourceAttributes(%q): %v", tt.list, err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("parseResourceAttributes(%q) = %v, want %v", tt.list, got, tt.want)
+		}
+	}
+}
+
+func TestParseResourceAttributesInvalid(t *testing.T) {
+	for _, list := range []string{"prod", "=prod", "team=robot%zzshop", "team=robot,shop"} {
+		if _, err := parseResourceAttributes(list); err == nil {
+			t.Errorf("parseResourceAttributes(%q) accepted", list)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+)
+
+// shared token the admin endpoints require as a bearer token, none when
+// empty
+var adminToken string
+
+// errPauseUnsupported is returned when the broker cannot pause consuming
+var errPauseUnsupported = errors.New("pausing is only supported with the amqp broker")
+
+// consumerPause stops and restarts consuming orders without dropping the
+// connection, so orders pile up in the queue meanwhile
+type consumerPause struct {
+	mu     sync.Mutex
+	paused bool
+
+	// closed on resume
+	resumed chan struct{}
+
+	// cancels the running consumers, nil when none are running
+	cancel func()
+}
+
+var pauser = &consumerPause{}
+
+// running registers cancel as the way to stop the consumers just started,
+// returning false if consuming was paused meanwhile
+func (p *consumerPause) running(cancel func()) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.paused {
+		return false
+	}
+	p.cancel = cancel
+
+	return true
+}
+
+// stopped clears the consumers registered by running once they have ended
+func (p *consumerPause) stopped() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.cancel = nil
+}
+
+// wait returns a channel closed once consuming is no longer paused
+func (p *consumerPause) wait() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.paused {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+
+	return p.resumed
+}
+
+// pause cancels the running consumers, the orders they already received
+// are still processed
+func (p *consumerPause) pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.paused {
+		return
+	}
+	p.paused = true
+	p.resumed = make(chan struct{})
+	if p.cancel != nil {
+		p.cancel()
+		p.cancel = nil
+	}
+	slog.Info("Consuming paused")
+}
+
+// resume lets the consumers start again
+func (p *consumerPause) resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.paused {
+		return
+	}
+	p.paused = false
+	close(p.resumed)
+	slog.Info("Consuming resumed")
+}
+
+func (p *consumerPause) isPaused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.paused
+}
+
+// adminOnly passes requests carrying DISPATCH_ADMIN_TOKEN as a bearer token
+// to next, or every request when no token is set
+func adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminToken != "" {
+			got := []byte(r.Header.Get("Authorization"))
+			if subtle.ConstantTimeCompare(got, []byte("Bearer "+adminToken)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// pauseHandler pauses consuming on POST, returning the new state
+func pauseHandler(w http.ResponseWriter, r *http.Request) {
+	setPaused(w, r, true)
+}
+
+// resumeHandler resumes consuming on POST, returning the new state
+func resumeHandler(w http.ResponseWriter, r *http.Request) {
+	setPaused(w, r, false)
+}
+
+func setPaused(w http.ResponseWriter, r *http.Request, paused bool) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if broker.System() != "rabbitmq" {
+		http.Error(w, errPauseUnsupported.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	if paused {
+		pauser.pause()
+	} else {
+		pauser.resume()
+	}
+	writeState(w)
+}
+
+// stateHandler returns whether consuming is paused as JSON
+func stateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeState(w)
+}
+
+func writeState(w http.ResponseWriter) {
+	state := struct {
+		Paused    bool `json:"paused"`
+		Connected bool `json:"connected"`
+	}{pauser.isPaused(), isConnected()}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(state); err != nil {
+		slog.Error("Failed to write state", "error", err)
+	}
+}
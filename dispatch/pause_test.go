@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// resumeAfter leaves consuming resumed once the test is done
+func resumeAfter(t *testing.T) {
+	t.Cleanup(pauser.resume)
+}
+
+// adminRequest sends method to path on server with auth as the
+// Authorization header, returning the response
+func adminRequest(server *http.Server, method, path, auth string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	rec := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, req)
+
+	return rec
+}
+
+// pausedState decodes whether the state in rec says consuming is paused
+func pausedState(t *testing.T, rec *httptest.ResponseRecorder) bool {
+	t.Helper()
+	var state struct {
+		Paused bool `json:"paused"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &state); err != nil {
+		t.Fatalf("decoding state %q: %v", rec.Body.String(), err)
+	}
+
+	return state.Paused
+}
+
+func TestPauseResumeHandlers(t *testing.T) {
+	prevToken := adminToken
+	t.Cleanup(func() { adminToken = prevToken })
+	adminToken = "s3cret"
+	useBroker(t, amqpBroker{})
+	resumeAfter(t)
+
+	server := startHealthServer("0", false)
+	t.Cleanup(func() { server.Close() })
+	const auth = "Bearer s3cret"
+
+	for _, path := range []string{"/admin/pause", "/admin/resume", "/admin/state"} {
+		if rec := adminRequest(server, http.MethodPost, path, "Bearer wrong"); rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s with the wrong token got %d, want %d", path, rec.Code, http.StatusUnauthorized)
+		}
+	}
+	if pauser.isPaused() {
+		t.Fatal("unauthorized request paused consuming")
+	}
+
+	if rec := adminRequest(server, http.MethodGet, "/admin/pause", auth); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /admin/pause got %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+
+	rec := adminRequest(server, http.MethodPost, "/admin/pause", auth)
+	if rec.Code != http.StatusOK || !pausedState(t, rec) {
+		t.Errorf("pausing got %d %q, want paused", rec.Code, rec.Body.String())
+	}
+	rec = adminRequest(server, http.MethodGet, "/admin/state", auth)
+	if rec.Code != http.StatusOK || !pausedState(t, rec) {
+		t.Errorf("state after pausing got %d %q, want paused", rec.Code, rec.Body.String())
+	}
+
+	rec = adminRequest(server, http.MethodPost, "/admin/resume", auth)
+	if rec.Code != http.StatusOK || pausedState(t, rec) {
+		t.Errorf("resuming got %d %q, want not paused", rec.Code, rec.Body.String())
+	}
+	rec = adminRequest(server, http.MethodGet, "/admin/state", auth)
+	if rec.Code != http.StatusOK || pausedState(t, rec) {
+		t.Errorf("state after resuming got %d %q, want not paused", rec.Code, rec.Body.String())
+	}
+}
+
+func TestPauseUnsupportedBroker(t *testing.T) {
+	useBroker(t, &fakeBroker{})
+	resumeAfter(t)
+
+	server := startHealthServer("0", false)
+	t.Cleanup(func() { server.Close() })
+
+	if rec := adminRequest(server, http.MethodPost, "/admin/pause", ""); rec.Code != http.StatusNotImplemented {
+		t.Errorf("pausing with the %s broker got %d, want %d", broker.System(), rec.Code, http.StatusNotImplemented)
+	}
+	if pauser.isPaused() {
+		t.Error("consuming paused with a broker that cannot pause")
+	}
+}
+
+func TestPauseStopsConsumeChannel(t *testing.T) {
+	prevAck := manualAck
+	t.Cleanup(func() { manualAck = prevAck })
+	manualAck = true
+	resumeAfter(t)
+
+	ch := newFakeChannel()
+	usable := make(chan bool, 1)
+	go func() {
+		usable <- consumeChannel(context.Background(), ch, make(chan Delivery))
+	}()
+	waitConsuming(t, ch, queueName)
+
+	// pausing cancels the consumers but keeps the channel
+	pauser.pause()
+	select {
+	case ok := <-usable:
+		if !ok {
+			t.Error("channel reported unusable after pausing")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("consuming did not stop when paused")
+	}
+	if ch.consuming(queueName) {
+		t.Error("still consuming while paused")
+	}
+
+	// consumers started while paused are cancelled straight away
+	go func() {
+		usable <- consumeChannel(context.Background(), ch, make(chan Delivery))
+	}()
+	select {
+	case ok := <-usable:
+		if !ok {
+			t.Error("channel reported unusable while paused")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("consuming started while paused")
+	}
+	if ch.consuming(queueName) {
+		t.Error("consumer left running while paused")
+	}
+}
+
+func TestAMQPBrokerPauseResume(t *testing.T) {
+	resumeAfter(t)
+	dialed := consumeFromFake(t)
+
+	consumer := (<-dialed).channel(0)
+	waitConsuming(t, consumer, queueName)
+
+	pauser.pause()
+	waitFor(t, "the consumer to be cancelled", func() bool { return !consumer.consuming(queueName) })
+	if consumer.deliver(queueName, amqp.Delivery{Headers: amqp.Table{}, Body: orderBody(uniqueID(t))}) {
+		t.Fatal("order delivered while paused")
+	}
+
+	// the same channel is consumed from again on resume
+	pauser.resume()
+	waitConsuming(t, consumer, queueName)
+	consumer.deliver(queueName, amqp.Delivery{Headers: amqp.Table{}, Body: orderBody(uniqueID(t))})
+	waitAcked(t, consumer)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	promProcessed  prometheus.Counter
+	promErrors     prometheus.Counter
+	promReconnects prometheus.Counter
+	promLatency    prometheus.Histogram
+	promInflight   prometheus.GaugeFunc
+	promUnroutable prometheus.Counter
+	promQueueDepth *prometheus.GaugeVec
+	promMessageAge prometheus.Histogram
+	promDowntime   prometheus.Histogram
+)
+
+// initPrometheus registers the Prometheus metrics, each name starting with
+// prefix
+func initPrometheus(prefix string) {
+	promProcessed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: prefix,
+		Name:      "orders_processed_total",
+		Help:      "Orders processed",
+	})
+	promErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: prefix,
+		Name:      "orders_errors_total",
+		Help:      "Orders that failed processing",
+	})
+	promReconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: prefix,
+		Name:      "rabbitmq_reconnects_total",
+		Help:      "Reconnections to RabbitMQ after the connection was lost",
+	})
+	promLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: prefix,
+		Name:      "processing_duration_seconds",
+		Help:      "Time taken to process an order",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	promInflight = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: prefix,
+		Name:      "orders_inflight",
+		Help:      "Orders being processed",
+	}, func() float64 {
+		return float64(inflightOrders.Load())
+	})
+
+	promUnroutable = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: prefix,
+		Name:      "publish_unroutable_total",
+		Help:      "Messages returned by the broker as unroutable",
+	})
+
+	promQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: prefix,
+		Name:      "queue_depth",
+		Help:      "Messages ready in the orders queue",
+	}, []string{"queue"})
+
+	promMessageAge = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: prefix,
+		Name:      "message_age_seconds",
+		Help:      "Time an order waited in the queue before it was consumed",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 10),
+	})
+
+	promDowntime = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: prefix,
+		Name:      "rabbitmq_downtime_seconds",
+		Help:      "Time from losing the connection to RabbitMQ until consuming again",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+	})
+
+	prometheus.MustRegister(promProcessed, promErrors, promReconnects, promLatency, promInflight, promUnroutable, promQueueDepth, promMessageAge, promDowntime)
+}
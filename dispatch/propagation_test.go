@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestExtractBaggage(t *testing.T) {
+	headers := AMQPHeaderCarrier{"baggage": "tenant=acme,tier=gold"}
+
+	bag := baggage.FromContext(otel.GetTextMapPropagator().Extract(context.Background(), headers))
+	if got := bag.Member("tenant").Value(); got != "acme" {
+		t.Errorf("tenant %q, want acme", got)
+	}
+	if got := bag.Member("tier").Value(); got != "gold" {
+		t.Errorf("tier %q, want gold", got)
+	}
+}
+
+func TestCreateSpanTenantFromBaggage(t *testing.T) {
+	spans := recordSpans(t)
+
+	err := createSpan(context.Background(), Delivery{
+		Headers: AMQPHeaderCarrier{"baggage": "tenant=acme"},
+		Body:    orderBody(uniqueID(t)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := spanAttrs(findSpan(t, spans, "getOrder"))["tenant"]; got.AsString() != "acme" {
+		t.Errorf("tenant %q, want acme", got.AsString())
+	}
+}
+
+func TestAMQPHeaderCarrierRoundTrip(t *testing.T) {
+	recordSpans(t)
+	ctx, span := otel.Tracer("test").Start(context.Background(), "publish")
+	defer span.End()
+
+	headers := AMQPHeaderCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, headers)
+	if headers.Get("traceparent") == "" {
+		t.Fatalf("no traceparent injected, headers %v", headers)
+	}
+
+	sc := trace.SpanContextFromContext(otel.GetTextMapPropagator().Extract(context.Background(), headers))
+	if sc.TraceID() != span.SpanContext().TraceID() {
+		t.Errorf("extracted trace %s, want %s", sc.TraceID(), span.SpanContext().TraceID())
+	}
+	if sc.SpanID() != span.SpanContext().SpanID() {
+		t.Errorf("extracted span %s, want %s", sc.SpanID(), span.SpanContext().SpanID())
+	}
+	if !sc.IsRemote() {
+		t.Error("extracted span context is not remote")
+	}
+}
+
+func TestAMQPHeaderCarrierExtractInvalid(t *testing.T) {
+	tests := map[string]AMQPHeaderCarrier{
+		"nil headers":          nil,
+		"no traceparent":       {"x-retry-count": int64(1)},
+		"malformed":            {"traceparent": "00-not-a-trace-01"},
+		"zero trace id":        {"traceparent": "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		"traceparent not text": {"traceparent": []byte("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")},
+	}
+	for name, headers := range tests {
+		ctx := otel.GetTextMapPropagator().Extract(context.Background(), headers)
+		if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+			t.Errorf("%s: extracted span context %v, want none", name, sc)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestNewPropagatorB3(t *testing.T) {
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+	tests := map[string]AMQPHeaderCarrier{
+		"b3":      {"b3": traceID + "-" + spanID + "-1"},
+		"b3multi": {"x-b3-traceid": traceID, "x-b3-spanid": spanID, "x-b3-sampled": "1"},
+	}
+	for name, headers := range tests {
+		t.Run(name, func(t *testing.T) {
+			prop, err := newPropagator("tracecontext," + name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sc := trace.SpanContextFromContext(prop.Extract(context.Background(), headers))
+			if sc.TraceID().String() != traceID || sc.SpanID().String() != spanID {
+				t.Errorf("extracted %s/%s, want %s/%s", sc.TraceID(), sc.SpanID(), traceID, spanID)
+			}
+			if !sc.IsSampled() || !sc.IsRemote() {
+				t.Errorf("extracted sampled %t remote %t, want both", sc.IsSampled(), sc.IsRemote())
+			}
+		})
+	}
+}
+
+func TestNewPropagatorUnknown(t *testing.T) {
+	if _, err := newPropagator("tracecontext,xray"); err == nil {
+		t.Error("unknown propagator accepted")
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	// backoff between attempts to publish a confirmation
+	publishRetryBase = 100 * time.Millisecond
+	publishRetryMax  = 2 * time.Second
+)
+
+var (
+	// how long to wait for the broker to confirm a publish
+	confirmTimeout = 5 * time.Second
+
+	// where confirmations are published, each gets a copy
+	confirmTargets []confirmTarget
+
+	publishAttempts    int
+	requeueUnconfirmed bool
+
+	// number of channels publishes are spread over
+	publishChannels int
+
+	// publishing channels in confirm mode, replaced on reconnect
+	pubMu   sync.Mutex
+	pubPool *publisherPool
+)
+
+// confirmTarget is an exchange and routing key confirmations are published
+// to
+type confirmTarget struct {
+	exchange string
+	key      string
+}
+
+func (t confirmTarget) String() string {
+	return t.exchange + ":" + t.key
+}
+
+// confirmExchanges returns the exchanges confirmations are published to
+// other than the orders exchange, each once
+func confirmExchanges() []string {
+	var exchanges []string
+	for _, t := range confirmTargets {
+		if t.exchange != exchangeName && !slices.Contains(exchanges, t.exchange) {
+			exchanges = append(exchanges, t.exchange)
+		}
+	}
+
+	return exchanges
+}
+
+// publisher is a confirm mode channel with the publishes on it waiting for
+// their confirm, keyed by delivery tag
+type publisher struct {
+	ch amqpChannel
+
+	mu      sync.Mutex
+	seq     uint64
+	waiting map[uint64]chan error
+	closed  bool
+}
+
+// newPublisher starts reading the confirms and returns of ch so the
+// connection never waits on them, whether or not a publish is waiting
+func newPublisher(ch amqpChannel) *publisher {
+	p := &publisher{ch: ch, waiting: map[uint64]chan error{}}
+	go p.drain(ch.NotifyPublish(make(chan amqp.Confirmation, 1)), ch.NotifyReturn(make(chan amqp.Return, 1)))
+
+	return p
+}
+
+// drain passes each confirm on to the publish waiting for it until the
+// channel closes, failing the publishes still waiting then. Confirms of
+// publishes that timed out are dropped
+func (p *publisher) drain(confirms chan amqp.Confirmation, returns chan amqp.Return) {
+	// the broker sends a return before the confirm of the same message
+	var returned *amqp.Return
+	for {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			returned = &r
+		case c, ok := <-confirms:
+			if !ok {
+				p.mu.Lock()
+				p.closed = true
+				for tag, wait := range p.waiting {
+					wait <- fmt.Errorf("publish channel closed before confirm")
+					delete(p.waiting, tag)
+				}
+				p.mu.Unlock()
+				return
+			}
+			// a return sent with the confirm may not have been read yet
+			select {
+			case r, ok := <-returns:
+				if ok {
+					returned = &r
+				}
+			default:
+			}
+
+			var err error
+			if !c.Ack {
+				err = fmt.Errorf("publish not acknowledged by broker")
+			} else if returned != nil {
+				err = fmt.Errorf("%w: %s to %q with key %q", errUnroutable, returned.ReplyText, returned.Exchange, returned.RoutingKey)
+			}
+			returned = nil
+
+			p.mu.Lock()
+			if wait, ok := p.waiting[c.DeliveryTag]; ok {
+				wait <- err
+				delete(p.waiting, c.DeliveryTag)
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+// publish publishes msg on the channel, returning what its confirm is
+// passed to. Only the holder of p publishes on it
+func (p *publisher) publish(exchange string, key string, mandatory bool, msg amqp.Publishing) (uint64, chan error, error) {
+	// waiting before publishing, as the confirm can come before Publish
+	// returns. The library only counts publishes that were sent
+	tag := p.seq + 1
+	wait := make(chan error, 1)
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return 0, nil, fmt.Errorf("publish channel closed")
+	}
+	p.waiting[tag] = wait
+	p.mu.Unlock()
+
+	if err := p.ch.Publish(exchange, key, mandatory, false, msg); err != nil {
+		p.forget(tag)
+		return 0, nil, err
+	}
+	p.seq = tag
+
+	return tag, wait, nil
+}
+
+// forget stops waiting for the confirm of tag
+func (p *publisher) forget(tag uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.waiting, tag)
+}
+
+// publisherPool holds the idle publishers of one connection
+type publisherPool struct {
+	mu     sync.Mutex
+	idle   chan *publisher
+	done   chan struct{}
+	closed bool
+}
+
+// acquire takes an idle publisher, waiting up to timeout for one to be
+// released
+func (pp *publisherPool) acquire(timeout time.Duration) (*publisher, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case p := <-pp.idle:
+		return p, nil
+	case <-pp.done:
+		return nil, fmt.Errorf("publish channels closed")
+	case <-timer.C:
+		return nil, fmt.Errorf("timed out waiting for a publish channel")
+	}
+}
+
+// release returns p to the pool, or closes it if the pool has been closed
+// meanwhile
+func (pp *publisherPool) release(p *publisher) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	if pp.closed {
+		p.ch.Close()
+		return
+	}
+	pp.idle <- p
+}
+
+// close closes the idle publishers, the busy ones are closed on release
+func (pp *publisherPool) close() {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	if pp.closed {
+		return
+	}
+	pp.closed = true
+	close(pp.done)
+
+	for {
+		select {
+		case p := <-pp.idle:
+			p.ch.Close()
+		default:
+			return
+		}
+	}
+}
+
+// errUnroutable marks publishes the broker returned as no queue was bound to
+// take them
+var errUnroutable = errors.New("message unroutable")
+
+// version of the Confirmation schema, raised when fields change meaning or
+// are removed
+const confirmationVersion = 1
+
+// Confirmation is published once an order has been dispatched, and once a
+// failed order is given up on with the error it failed with
+type Confirmation struct {
+	Version    int     `json:"version"`
+	OrderID    string  `json:"orderid"`
+	DataCenter string  `json:"datacenter"`
+	Status     string  `json:"status"`
+	DurationMs float64 `json:"duration_ms"`
+
+	// empty unless processing failed
+	Error string `json:"error"`
+}
+
+// openPublisher creates the pool of confirm mode channels used for
+// publishing, closed is notified if the broker closes any of them
+func openPublisher(conn amqpConnection, closed chan *amqp.Error) error {
+	pool := &publisherPool{
+		idle: make(chan *publisher, publishChannels),
+		done: make(chan struct{}),
+	}
+
+	for i := 0; i < publishChannels; i++ {
+		ch, err := conn.Channel()
+		if err != nil {
+			pool.close()
+			return err
+		}
+		if err := ch.Confirm(false); err != nil {
+			ch.Close()
+			pool.close()
+			return err
+		}
+
+		// the library closes each notify channel, so every publishing
+		// channel gets its own and the first error is passed on
+		chanClosed := ch.NotifyClose(make(chan *amqp.Error, 1))
+		go func() {
+			if err, ok := <-chanClosed; ok {
+				select {
+				case closed <- err:
+				default:
+				}
+			}
+		}()
+
+		pool.idle <- newPublisher(ch)
+	}
+
+	pubMu.Lock()
+	defer pubMu.Unlock()
+	pubPool = pool
+
+	return nil
+}
+
+// closePublisher closes the publishing channels if they are open
+func closePublisher() {
+	pubMu.Lock()
+	defer pubMu.Unlock()
+
+	if pubPool != nil {
+		pubPool.close()
+		pubPool = nil
+	}
+}
+
+// publishConfirmation publishes the dispatch result of an order to every
+// confirm target and waits for the broker to confirm them, continuing the
+// trace in ctx. The targets are published to at the same time so one
+// failing does not hold up the others. An error, joining those of every
+// target, is only returned when all of them failed, as retrying the order
+// would confirm it again to the targets that have it
+func publishConfirmation(ctx context.Context, tracer trace.Tracer, confirmation Confirmation) error {
+	ctx, span := tracer.Start(ctx, "publishConfirmation", trace.WithSpanKind(trace.SpanKindProducer))
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("messaging.system", broker.System()),
+		attribute.String("orderid", confirmation.OrderID),
+		attribute.Int("confirm.targets", len(confirmTargets)),
+	)
+
+	confirmation.Version = confirmationVersion
+	body, err := json.Marshal(confirmation)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	errs := make([]error, len(confirmTargets))
+	var wg sync.WaitGroup
+	for i, target := range confirmTargets {
+		wg.Go(func() {
+			errs[i] = publishTarget(ctx, tracer, target, confirmation.OrderID, body)
+		})
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+	span.SetAttributes(attribute.Int("confirm.failed", failed))
+	if failed == 0 {
+		return nil
+	}
+
+	err = errors.Join(errs...)
+	span.RecordError(err)
+	span.SetStatus(codes.Error, fmt.Sprintf("%d of %d confirm targets failed", failed, len(confirmTargets)))
+	if failed < len(confirmTargets) {
+		slog.WarnContext(ctx, "Confirmation not published to every target", "orderid", confirmation.OrderID, "failed", failed, "targets", len(confirmTargets), "error", err)
+		return nil
+	}
+
+	return err
+}
+
+// publishTarget publishes the confirmation body of order to target in a
+// child span, trying up to publishAttempts times
+func publishTarget(ctx context.Context, tracer trace.Tracer, target confirmTarget, order string, body []byte) error {
+	ctx, span := tracer.Start(ctx, "publish "+target.exchange, trace.WithSpanKind(trace.SpanKindProducer))
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("messaging.system", broker.System()),
+		attribute.String("messaging.destination", target.exchange),
+		attribute.String("messaging.rabbitmq.routing_key", target.key),
+		attribute.String("orderid", order),
+	)
+
+	var err error
+	for attempt := 1; attempt <= publishAttempts; attempt++ {
+		err = broker.Publish(ctx, target.exchange, target.key, body)
+		if err == nil {
+			return nil
+		}
+
+		// nothing is bound to take the confirmation, which publishing
+		// again or retrying the order cannot change, so it is only
+		// reported
+		if errors.Is(err, errUnroutable) {
+			span.AddEvent("unroutable", trace.WithAttributes(attribute.String("error", err.Error())))
+			recordUnroutable(ctx, target.exchange, target.key)
+			slog.WarnContext(ctx, "Confirmation unroutable, no queue is bound to the target", "orderid", order, "target", target.String())
+			return nil
+		}
+		slog.WarnContext(ctx, "Failed to publish confirmation", "orderid", order, "target", target.String(), "attempt", attempt, "error", err)
+
+		if attempt < publishAttempts {
+			if sleep(ctx, backoffDelay(attempt, publishRetryBase, publishRetryMax)) != nil {
+				break
+			}
+		}
+	}
+
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	slog.ErrorContext(ctx, "Giving up publishing confirmation", "orderid", order, "target", target.String(), "error", err)
+
+	return fmt.Errorf("%s: %w", target, err)
+}
+
+// publishMessage publishes msg on an idle publishing channel and waits for
+// the broker to confirm it. Mandatory messages are returned by the broker if
+// they cannot be routed
+func publishMessage(exchange string, key string, mandatory bool, msg amqp.Publishing) error {
+	pubMu.Lock()
+	pool := pubPool
+	pubMu.Unlock()
+
+	if pool == nil {
+		return fmt.Errorf("publish channel not open")
+	}
+
+	p, err := pool.acquire(confirmTimeout)
+	if err != nil {
+		return err
+	}
+	defer pool.release(p)
+
+	tag, wait, err := p.publish(exchange, key, mandatory, msg)
+	if err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(confirmTimeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-wait:
+		return err
+	case <-timer.C:
+		p.forget(tag)
+		return fmt.Errorf("timed out waiting for publish confirm")
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+
+	"github.com/streadway/amqp"
+)
+
+func TestPublishConfirmationUnroutable(t *testing.T) {
+	useBroker(t, &fakeBroker{onPublish: func(exchange string, key string) error {
+		return fmt.Errorf("%w: NO_ROUTE to %q with key %q", errUnroutable, exchange, key)
+	}})
+	spans := recordSpans(t)
+
+	err := publishConfirmation(context.Background(), otel.Tracer("test"), Confirmation{OrderID: "abc-1"})
+	if err != nil {
+		t.Errorf("unroutable confirmation failed the publish: %v", err)
+	}
+
+	var unroutable bool
+	for _, event := range findSpan(t, spans, "publish robot-shop").Events {
+		unroutable = unroutable || event.Name == "unroutable"
+	}
+	if !unroutable {
+		t.Error("no unroutable event")
+	}
+}
+
+func TestCreateSpanUnroutableConfirmation(t *testing.T) {
+	prev := requeueUnconfirmed
+	t.Cleanup(func() { requeueUnconfirmed = prev })
+	requeueUnconfirmed = true
+	useBroker(t, &fakeBroker{onPublish: func(string, string) error {
+		return fmt.Errorf("%w: NO_ROUTE", errUnroutable)
+	}})
+
+	err := createSpan(context.Background(), Delivery{Headers: propagation.MapCarrier{}, Body: orderBody(uniqueID(t))})
+	if err != nil {
+		t.Errorf("order failed for an unroutable confirmation: %v", err)
+	}
+}
+
+func TestConfirmationJSON(t *testing.T) {
+	b := &fakeBroker{}
+	useBroker(t, b)
+
+	id := uniqueID(t)
+	if err := createSpan(context.Background(), Delivery{Headers: propagation.MapCarrier{}, Body: orderBody(id)}); err != nil {
+		t.Fatal(err)
+	}
+	published := b.messages()
+	if len(published) != 1 {
+		t.Fatalf("%d confirmations published, want 1", len(published))
+	}
+
+	var confirmation map[string]any
+	if err := json.Unmarshal(published[0].body, &confirmation); err != nil {
+		t.Fatal(err)
+	}
+	keys := slices.Sorted(maps.Keys(confirmation))
+	if want := []string{"datacenter", "duration_ms", "error", "orderid", "status", "version"}; !slices.Equal(keys, want) {
+		t.Errorf("confirmation fields %v, want %v", keys, want)
+	}
+	if confirmation["version"] != float64(confirmationVersion) || confirmation["orderid"] != id || confirmation["status"] != "dispatched" || confirmation["error"] != "" {
+		t.Errorf("confirmation %v, want version %d of dispatched order %s", confirmation, confirmationVersion, id)
+	}
+}
+
+func TestFailureConfirmation(t *testing.T) {
+	prev := failPattern
+	t.Cleanup(func() { failPattern = prev })
+	failPattern = regexp.MustCompile(`^chaos-`)
+	b := &fakeBroker{}
+	useBroker(t, b)
+
+	// orders that are retried are not confirmed yet
+	d := Delivery{Headers: propagation.MapCarrier{}, Body: orderBody("chaos-" + uniqueID(t))}
+	if err := createSpan(context.Background(), d); err == nil {
+		t.Fatal("matching order did not fail")
+	}
+	if published := b.messages(); len(published) != 0 {
+		t.Fatalf("%d confirmations published for an order to retry, want none", len(published))
+	}
+
+	id := "chaos-" + uniqueID(t)
+	d = Delivery{Headers: propagation.MapCarrier{}, Body: orderBody(id), Redeliveries: int64(maxRetries)}
+	if err := createSpan(context.Background(), d); err == nil {
+		t.Fatal("matching order did not fail")
+	}
+	published := b.messages()
+	if len(published) != 1 {
+		t.Fatalf("%d confirmations published for an order out of retries, want 1", len(published))
+	}
+	var confirmation Confirmation
+	if err := json.Unmarshal(published[0].body, &confirmation); err != nil {
+		t.Fatal(err)
+	}
+	if confirmation.OrderID != id || confirmation.Status != "failed" || !strings.Contains(confirmation.Error, "matches") {
+		t.Errorf("confirmation %+v, want order %s failed with the SOP error", confirmation, id)
+	}
+}
+
+func TestPublishConfirmationPartialFailure(t *testing.T) {
+	prev := confirmTargets
+	t.Cleanup(func() { confirmTargets = prev })
+	confirmTargets = []confirmTarget{{"robot-shop", "dispatched"}, {"audit", "orders"}}
+
+	failing := map[string]bool{"audit": true}
+	b := &fakeBroker{onPublish: func(exchange string, key string) error {
+		if failing[exchange] {
+			return fmt.Errorf("publish to %s nacked", exchange)
+		}
+		return nil
+	}}
+	useBroker(t, b)
+
+	// the order is not retried for the target that failed
+	if err := publishConfirmation(context.Background(), otel.Tracer("test"), Confirmation{OrderID: "abc-1"}); err != nil {
+		t.Errorf("one of two targets failing failed the publish: %v", err)
+	}
+	if published := b.messages(); len(published) != 1 || published[0].exchange != "robot-shop" {
+		t.Errorf("published %+v, want the confirmation on robot-shop only", published)
+	}
+
+	failing["robot-shop"] = true
+	if err := publishConfirmation(context.Background(), otel.Tracer("test"), Confirmation{OrderID: "abc-1"}); err == nil {
+		t.Error("every target failing did not fail the publish")
+	}
+}
+
+// openFakePublisher opens the publishing channel on a fakeConnection for
+// the rest of the test
+func openFakePublisher(t *testing.T) *fakeChannel {
+	t.Helper()
+	prev := publishChannels
+	publishChannels = 1
+	conn := &fakeConnection{}
+	if err := openPublisher(conn, make(chan *amqp.Error, 1)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		closePublisher()
+		publishChannels = prev
+	})
+
+	return conn.channel(0)
+}
+
+// publishWithin publishes a confirmation body to the orders exchange,
+// failing the test if it does not finish in time
+func publishWithin(t *testing.T, mandatory bool) error {
+	t.Helper()
+	published := make(chan error, 1)
+	go func() {
+		published <- publishMessage(exchangeName, "dispatched", mandatory, amqp.Publishing{Body: []byte("{}")})
+	}()
+
+	select {
+	case err := <-published:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("publish did not finish")
+		return nil
+	}
+}
+
+func TestPublishMessageLateConfirm(t *testing.T) {
+	ch := openFakePublisher(t)
+	prev := confirmTimeout
+	t.Cleanup(func() { confirmTimeout = prev })
+	confirmTimeout = 10 * time.Millisecond
+
+	ch.holdConfirms()
+	if err := publishWithin(t, false); err == nil {
+		t.Fatal("publish confirmed while the confirm was held")
+	}
+	confirmTimeout = prev
+
+	// the broker confirming late is not held up, nor does it block the
+	// publishes after
+	released := make(chan struct{})
+	go func() {
+		ch.releaseConfirms()
+		close(released)
+	}()
+	select {
+	case <-released:
+	case <-time.After(5 * time.Second):
+		t.Fatal("late confirm not read")
+	}
+	for range 3 {
+		if err := publishWithin(t, false); err != nil {
+			t.Errorf("publish after a late confirm failed: %v", err)
+		}
+	}
+}
+
+func TestPublishMessageUnroutable(t *testing.T) {
+	ch := openFakePublisher(t)
+	ch.returnMandatory()
+
+	if err := publishWithin(t, true); !errors.Is(err, errUnroutable) {
+		t.Errorf("returned publish failed with %v, want unroutable", err)
+	}
+	// the return is only put down to the publish it came with
+	if err := publishWithin(t, false); err != nil {
+		t.Errorf("publish after a return failed: %v", err)
+	}
+}
+
+func TestPublishMessageChannelClosed(t *testing.T) {
+	ch := openFakePublisher(t)
+	ch.holdConfirms()
+
+	published := make(chan error, 1)
+	go func() {
+		published <- publishMessage(exchangeName, "dispatched", false, amqp.Publishing{Body: []byte("{}")})
+	}()
+	waitFor(t, "the publish", func() bool { return len(ch.messages()) == 1 })
+	ch.shutdown(&amqp.Error{Code: amqp.ChannelError, Reason: "channel lost"})
+
+	select {
+	case err := <-published:
+		if err == nil {
+			t.Error("publish confirmed on a closed channel")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("publish kept waiting after the channel closed")
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// messages ready in each consumed queue as of the last poll, by queue name
+var (
+	depthMu     sync.Mutex
+	queueDepths = map[string]int{}
+)
+
+// watchQueueDepth polls the depth of the consumed queues every interval
+// until ctx is done
+func watchQueueDepth(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pollQueueDepth()
+		}
+	}
+}
+
+// pollQueueDepth passively declares each consumed queue to read its depth.
+// A passive declare of a missing queue closes the channel, so each poll
+// uses a channel of its own
+func pollQueueDepth() {
+	conn := currentRabbitConn()
+	if conn == nil || conn.IsClosed() {
+		return
+	}
+
+	for _, tenant := range consumedTenants() {
+		name := tenantQueue(tenant)
+
+		ch, err := conn.Channel()
+		if err != nil {
+			slog.Warn("Failed to open channel for queue depth", "error", err)
+			return
+		}
+		q, err := ch.QueueDeclarePassive(name, true, false, false, false, nil)
+		if err != nil {
+			// the queue is gone until the consumer declares it again
+			slog.Warn("Failed to read queue depth", "queue", name, "error", err)
+			depthMu.Lock()
+			delete(queueDepths, name)
+			depthMu.Unlock()
+			promQueueDepth.DeleteLabelValues(name)
+			continue
+		}
+		ch.Close()
+
+		depthMu.Lock()
+		queueDepths[name] = q.Messages
+		depthMu.Unlock()
+		promQueueDepth.WithLabelValues(name).Set(float64(q.Messages))
+	}
+}
+
+// queueDepthSnapshot returns a copy of the last polled queue depths
+func queueDepthSnapshot() map[string]int {
+	depthMu.Lock()
+	defer depthMu.Unlock()
+
+	depths := make(map[string]int, len(queueDepths))
+	for name, n := range queueDepths {
+		depths[name] = n
+	}
+
+	return depths
+}
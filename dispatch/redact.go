@@ -0,0 +1,70 @@
+package main
+
+import (
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// replaces the values of redacted attributes
+const redactedValue = "***"
+
+// attribute keys whose values are redacted before spans are exported, from
+// DISPATCH_REDACT_ATTRS
+var redactAttrs []string
+
+// redactingProcessor passes ended spans on to next with the values of the
+// attributes in keys replaced, so they never reach the exporter
+type redactingProcessor struct {
+	sdktrace.SpanProcessor
+	keys map[attribute.Key]bool
+}
+
+func newRedactingProcessor(next sdktrace.SpanProcessor, keys []string) sdktrace.SpanProcessor {
+	p := redactingProcessor{
+		SpanProcessor: next,
+		keys:          make(map[attribute.Key]bool, len(keys)),
+	}
+	for _, key := range keys {
+		p.keys[attribute.Key(key)] = true
+	}
+
+	return p
+}
+
+func (p redactingProcessor) OnEnd(s sdktrace.ReadOnlySpan) {
+	p.SpanProcessor.OnEnd(redactedSpan{ReadOnlySpan: s, keys: p.keys})
+}
+
+// redactedSpan is a span with the values of some attributes replaced
+type redactedSpan struct {
+	sdktrace.ReadOnlySpan
+	keys map[attribute.Key]bool
+}
+
+func (s redactedSpan) Attributes() []attribute.KeyValue {
+	return redact(s.ReadOnlySpan.Attributes(), s.keys)
+}
+
+func (s redactedSpan) Events() []sdktrace.Event {
+	events := s.ReadOnlySpan.Events()
+	redacted := make([]sdktrace.Event, len(events))
+	for i, event := range events {
+		event.Attributes = redact(event.Attributes, s.keys)
+		redacted[i] = event
+	}
+
+	return redacted
+}
+
+// redact returns attrs with the values of the attributes in keys replaced
+func redact(attrs []attribute.KeyValue, keys map[attribute.Key]bool) []attribute.KeyValue {
+	redacted := make([]attribute.KeyValue, len(attrs))
+	for i, kv := range attrs {
+		if keys[kv.Key] {
+			kv = kv.Key.String(redactedValue)
+		}
+		redacted[i] = kv
+	}
+
+	return redacted
+}
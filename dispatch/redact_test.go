@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestRedactingProcessor(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(
+		newRedactingProcessor(sdktrace.NewSimpleSpanProcessor(exporter), []string{"enduser.id", "customer.email"})))
+	t.Cleanup(func() { tp.Shutdown(context.Background()) })
+
+	_, span := tp.Tracer("test").Start(context.Background(), "getOrder", trace.WithAttributes(
+		attribute.String("enduser.id", "alice"),
+		attribute.String("orderid", "abc-1"),
+	))
+	span.AddEvent("notified", trace.WithAttributes(attribute.String("customer.email", "alice@example.com")))
+	span.End()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("%d spans exported, want 1", len(spans))
+	}
+	attrs := spanAttrs(spans[0])
+	if got := attrs["enduser.id"].AsString(); got != redactedValue {
+		t.Errorf("enduser.id exported as %q, want %q", got, redactedValue)
+	}
+	if got := attrs["orderid"].AsString(); got != "abc-1" {
+		t.Errorf("orderid exported as %q, want it left alone", got)
+	}
+	events := spans[0].Events
+	if len(events) != 1 || len(events[0].Attributes) != 1 || events[0].Attributes[0].Value.AsString() != redactedValue {
+		t.Errorf("event exported as %+v, want customer.email redacted", events)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strconv"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// message header asking for the order to be traced whatever the sampling
+// ratio, for debugging particular orders
+const forceSampleHeader = "x-force-sample"
+
+// span attribute that makes forceSampler sample the span
+const forceSampleAttr = attribute.Key("sampling.force")
+
+// forceSampler samples spans started with forceSampleAttr set, leaving the
+// others to the sampler it wraps. Children of a forced span are sampled by
+// the parent based sampler as usual
+type forceSampler struct {
+	sdktrace.Sampler
+}
+
+func (s forceSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	for _, attr := range p.Attributes {
+		if attr.Key == forceSampleAttr && attr.Value.AsBool() {
+			result := s.Sampler.ShouldSample(p)
+			result.Decision = sdktrace.RecordAndSample
+			return result
+		}
+	}
+
+	return s.Sampler.ShouldSample(p)
+}
+
+func (s forceSampler) Description() string {
+	return "ForceSampler{" + s.Sampler.Description() + "}"
+}
+
+// forceSampled reports whether the producer of d asked for it to be traced
+func forceSampled(d Delivery) bool {
+	force, err := strconv.ParseBool(d.Headers.Get(forceSampleHeader))
+	return err == nil && force
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+)
+
+// neverSampleSpans exports the spans forceSampler picks from a sampling
+// ratio of zero for the rest of the test
+func neverSampleSpans(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithSyncer(exporter),
+		sdktrace.WithSampler(forceSampler{sdktrace.ParentBased(sdktrace.TraceIDRatioBased(0))}),
+	)
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(tracenoop.NewTracerProvider())
+		tp.Shutdown(context.Background())
+	})
+
+	return exporter
+}
+
+func TestForceSampleHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers propagation.MapCarrier
+		want    bool
+	}{
+		{"forced", propagation.MapCarrier{forceSampleHeader: "true"}, true},
+		{"forced under an unsampled parent", propagation.MapCarrier{
+			forceSampleHeader: "1",
+			"traceparent":     "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00",
+		}, true},
+		{"not forced", propagation.MapCarrier{forceSampleHeader: "false"}, false},
+		{"no header", propagation.MapCarrier{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spans := neverSampleSpans(t)
+
+			if err := createSpan(context.Background(), Delivery{Headers: tt.headers, Body: orderBody(uniqueID(t))}); err != nil {
+				t.Fatal(err)
+			}
+
+			exported := false
+			for _, span := range spans.GetSpans() {
+				exported = exported || span.Name == "getOrder"
+			}
+			if exported != tt.want {
+				t.Errorf("getOrder exported %t, want %t", exported, tt.want)
+			}
+		})
+	}
+}
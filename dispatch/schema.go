@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+// orderSchema validates order bodies when DISPATCH_ORDER_SCHEMA is set
+var orderSchema *jsonschema.Schema
+
+// loadOrderSchema compiles the JSON Schema at path
+func loadOrderSchema(path string) (*jsonschema.Schema, error) {
+	return jsonschema.NewCompiler().Compile(path)
+}
+
+// validateOrder checks body against the order schema, if any. Orders that
+// are not JSON are invalid, those not matching the schema are failed
+// permanently so they are kept in the dead letter queue
+func validateOrder(body []byte) error {
+	if orderSchema == nil {
+		return nil
+	}
+
+	inst, err := jsonschema.UnmarshalJSON(bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: %w", errInvalidOrder, err)
+	}
+	if err := orderSchema.Validate(inst); err != nil {
+		return permanent(fmt.Errorf("order does not match the schema: %w", err))
+	}
+
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateOrderSchemaFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "order.json")
+	schema := `{"type": "object", "required": ["orderid", "user"]}`
+	if err := os.WriteFile(path, []byte(schema), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	compiled, err := loadOrderSchema(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := orderSchema
+	t.Cleanup(func() { orderSchema = prev })
+	orderSchema = compiled
+
+	if err := validateOrder([]byte(`{"orderid": "abc-1", "user": "alice"}`)); err != nil {
+		t.Errorf("valid order rejected: %v", err)
+	}
+
+	err = validateOrder([]byte(`{"orderid": "abc-1"}`))
+	if got := classify(err); got != dispositionDeadLetter {
+		t.Errorf("order not matching the schema classified %s, want dead_letter", got)
+	}
+
+	err = validateOrder([]byte(`{"orderid": `))
+	if got := classify(err); got != dispositionDrop {
+		t.Errorf("malformed order classified %s, want drop", got)
+	}
+}
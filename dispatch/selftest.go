@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// with selfTest set the service is not ready until a sentinel order has made
+// the round trip through RabbitMQ
+var (
+	selfTest       bool
+	selfTestPassed atomic.Bool
+)
+
+// runSelfTest repeats the self test once connected until it passes or ctx
+// is done
+func runSelfTest(ctx context.Context) {
+	for attempt := 1; ; attempt++ {
+		if isConnected() {
+			err := selfTestRoundTrip()
+			if err == nil {
+				selfTestPassed.Store(true)
+				slog.Info("Self test passed", "attempt", attempt)
+				return
+			}
+			slog.Error("Self test failed", "attempt", attempt, "error", err)
+		}
+
+		if sleep(ctx, backoffDelay(attempt, reconnectBase, reconnectMax)) != nil {
+			return
+		}
+	}
+}
+
+// selfTestRoundTrip publishes a sentinel order to a temporary queue through
+// a confirmed publish and consumes it again
+func selfTestRoundTrip() error {
+	conn := currentRabbitConn()
+	if conn == nil || conn.IsClosed() {
+		return fmt.Errorf("not connected")
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("opening channel: %w", err)
+	}
+	defer ch.Close()
+
+	// server named, removed once this channel closes
+	queue, err := ch.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		return fmt.Errorf("declaring queue: %w", err)
+	}
+	msgs, err := ch.Consume(queue.Name, "", true, true, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("consuming: %w", err)
+	}
+
+	sentinel := fmt.Sprintf("selftest-%d", time.Now().UnixNano())
+	err = publishMessage("", queue.Name, true, amqp.Publishing{
+		ContentType: "application/json",
+		MessageId:   sentinel,
+		Body:        []byte(fmt.Sprintf(`{"orderid":%q}`, sentinel)),
+	})
+	if err != nil {
+		return fmt.Errorf("publishing: %w", err)
+	}
+
+	select {
+	case d, ok := <-msgs:
+		if !ok {
+			return fmt.Errorf("channel closed before the sentinel arrived")
+		}
+		if d.MessageId != sentinel {
+			return fmt.Errorf("received %q instead of the sentinel", d.MessageId)
+		}
+		return nil
+	case <-time.After(confirmTimeout):
+		return fmt.Errorf("timed out waiting for the sentinel")
+	}
+}
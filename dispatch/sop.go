@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// baggage members a call to the SOP carries along with the order
+const (
+	orderIDMember    = "orderid"
+	dataCenterMember = "datacenter"
+)
+
+// sopCarrier returns the headers a call to the SOP would send, the baggage
+// of ctx with the order id and data center added. Only baggage is injected,
+// whatever OTEL_PROPAGATORS says, so the SOP always gets it
+func sopCarrier(ctx context.Context, orderID, dataCenter string) propagation.MapCarrier {
+	if orderID != "" {
+		ctx = withBaggageMember(ctx, orderIDMember, orderID)
+	}
+	if dataCenter != "" {
+		ctx = withBaggageMember(ctx, dataCenterMember, dataCenter)
+	}
+
+	carrier := propagation.MapCarrier{}
+	propagation.Baggage{}.Inject(ctx, carrier)
+
+	return carrier
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+func TestSOPCarrierBaggage(t *testing.T) {
+	// baggage reaches the SOP even when it is not among the propagators
+	prev := otel.GetTextMapPropagator()
+	t.Cleanup(func() { otel.SetTextMapPropagator(prev) })
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	incoming := propagation.Baggage{}.Extract(context.Background(), AMQPHeaderCarrier{"baggage": "tenant=acme"})
+	carrier := sopCarrier(incoming, "abc-1", "us-east1")
+
+	bag := baggage.FromContext(propagation.Baggage{}.Extract(context.Background(), carrier))
+	want := map[string]string{"tenant": "acme", orderIDMember: "abc-1", dataCenterMember: "us-east1"}
+	for key, value := range want {
+		if got := bag.Member(key).Value(); got != value {
+			t.Errorf("SOP baggage %s = %q, want %q", key, got, value)
+		}
+	}
+	if bag.Len() != len(want) {
+		t.Errorf("SOP baggage %s, want only %v", bag, want)
+	}
+}
+
+func TestSOPCarrierOmitsUnknown(t *testing.T) {
+	carrier := sopCarrier(context.Background(), "abc-1", "")
+
+	bag := baggage.FromContext(propagation.Baggage{}.Extract(context.Background(), carrier))
+	if got := bag.Member(orderIDMember).Value(); got != "abc-1" {
+		t.Errorf("SOP baggage orderid = %q, want abc-1", got)
+	}
+	if bag.Len() != 1 {
+		t.Errorf("SOP baggage %s, want only the order id", bag)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// paths of the order fields added to the order span, from
+// DISPATCH_SPAN_ATTR_FIELDS
+var spanAttrFields [][]string
+
+// parseFieldPath splits a path such as $.cart.items.0.sku into its keys,
+// array elements are picked by index
+func parseFieldPath(path string) ([]string, error) {
+	keys := strings.Split(strings.TrimPrefix(path, "$."), ".")
+	for _, key := range keys {
+		if key == "" {
+			return nil, fmt.Errorf("empty key in %q", path)
+		}
+	}
+
+	return keys, nil
+}
+
+// orderFieldAttrs returns an order.<path> attribute for each of
+// spanAttrFields found in the JSON body, skipping the paths it does not
+// have. Objects and arrays are added as JSON
+func orderFieldAttrs(body []byte) []attribute.KeyValue {
+	var doc any
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil
+	}
+
+	var attrs []attribute.KeyValue
+	for _, path := range spanAttrFields {
+		value, ok := lookupField(doc, path)
+		if !ok {
+			continue
+		}
+		key := "order." + strings.Join(path, ".")
+
+		switch v := value.(type) {
+		case string:
+			attrs = append(attrs, attribute.String(key, v))
+		case float64:
+			attrs = append(attrs, attribute.Float64(key, v))
+		case bool:
+			attrs = append(attrs, attribute.Bool(key, v))
+		case nil:
+			continue
+		default:
+			b, err := json.Marshal(v)
+			if err != nil {
+				continue
+			}
+			attrs = append(attrs, attribute.String(key, string(b)))
+		}
+	}
+
+	return attrs
+}
+
+// lookupField returns the value at path in a decoded JSON document
+func lookupField(doc any, path []string) (any, bool) {
+	for _, key := range path {
+		switch node := doc.(type) {
+		case map[string]any:
+			v, ok := node[key]
+			if !ok {
+				return nil, false
+			}
+			doc = v
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			doc = node[i]
+		default:
+			return nil, false
+		}
+	}
+
+	return doc, true
+}
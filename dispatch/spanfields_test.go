@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestLookupField(t *testing.T) {
+	var doc any
+	if err := json.Unmarshal(orderBody("abc-1"), &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	found := []struct {
+		path string
+		want any
+	}{
+		{"$.orderid", "abc-1"},
+		{"$.cart.total", 10.0},
+		{"$.cart.items.0.sku", "RB1"},
+		{"cart.items.0.qty", 1.0},
+		{"$.cart.items.0", map[string]any{"sku": "RB1", "name": "Robot", "qty": 1.0, "price": 10.0, "subtotal": 10.0}},
+	}
+	for _, tt := range found {
+		path, err := parseFieldPath(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := lookupField(doc, path)
+		if !ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("lookupField(%s) = %v, %t, want %v", tt.path, got, ok, tt.want)
+		}
+	}
+
+	missing := []string{
+		"$.customer",
+		"$.cart.discount",
+		"$.cart.items.1.sku",
+		"$.cart.items.-1",
+		"$.cart.items.first",
+		"$.orderid.length",
+		"$.cart.total.currency",
+	}
+	for _, p := range missing {
+		path, err := parseFieldPath(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, ok := lookupField(doc, path); ok {
+			t.Errorf("lookupField(%s) = %v, want it missing", p, got)
+		}
+	}
+}
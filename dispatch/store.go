@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	_ "github.com/lib/pq"
+)
+
+const createDispatchTable = `CREATE TABLE IF NOT EXISTS dispatches (
+	orderid       TEXT NOT NULL,
+	datacenter    TEXT NOT NULL,
+	status        TEXT NOT NULL,
+	dispatched_at TIMESTAMPTZ NOT NULL
+)`
+
+const insertDispatch = `INSERT INTO dispatches (orderid, datacenter, status, dispatched_at) VALUES ($1, $2, $3, $4)`
+
+// store records dispatched orders, a no-op unless DISPATCH_DB_DSN is set
+var store DispatchStore = noopStore{}
+
+// DispatchRecord is the audit record of a dispatched order
+type DispatchRecord struct {
+	OrderID      string
+	DataCenter   string
+	Status       string
+	DispatchedAt time.Time
+}
+
+// DispatchStore persists dispatch records
+type DispatchStore interface {
+	Save(ctx context.Context, record DispatchRecord) error
+	Close() error
+}
+
+type noopStore struct{}
+
+func (noopStore) Save(ctx context.Context, record DispatchRecord) error { return nil }
+func (noopStore) Close() error                                          { return nil }
+
+// how long to wait for the database to create the table at startup
+const storeSetupTimeout = 10 * time.Second
+
+// postgresStore writes dispatch records to Postgres
+type postgresStore struct {
+	db *sql.DB
+}
+
+// newPostgresStore opens dsn and creates the table, once here rather than
+// from the workers, which would race to create it
+func newPostgresStore(dsn string) (*postgresStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(maxConcurrency)
+	db.SetConnMaxIdleTime(5 * time.Minute)
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeSetupTimeout)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, createDispatchTable); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating dispatches table: %w", err)
+	}
+
+	return &postgresStore{db: db}, nil
+}
+
+func (s *postgresStore) Save(ctx context.Context, record DispatchRecord) error {
+	_, err := s.db.ExecContext(ctx, insertDispatch,
+		record.OrderID, record.DataCenter, record.Status, record.DispatchedAt)
+
+	return err
+}
+
+func (s *postgresStore) Close() error {
+	return s.db.Close()
+}
+
+// saveDispatch stores the dispatch record in a child span of ctx
+func saveDispatch(ctx context.Context, record DispatchRecord) error {
+	if _, ok := store.(noopStore); ok {
+		return nil
+	}
+
+	ctx, span := otel.Tracer("dispatch-service").Start(ctx, "saveDispatch", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("db.system", "postgresql"),
+		attribute.String("db.operation", "INSERT"),
+		attribute.String("db.sql.table", "dispatches"),
+		attribute.String("orderid", record.OrderID),
+	)
+
+	err := store.Save(ctx, record)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	return err
+}
@@ -0,0 +1,43 @@
+package main
+
+// tenants whose orders are consumed from queues of their own, empty when all
+// orders share the one queue
+var tenants []string
+
+// consumedTenants returns the tenants to consume orders for, with "" standing
+// for the shared queue when there are none
+func consumedTenants() []string {
+	if len(tenants) == 0 {
+		return []string{""}
+	}
+
+	return tenants
+}
+
+// tenantQueue names the orders queue of tenant
+func tenantQueue(tenant string) string {
+	if tenant == "" {
+		return queueName
+	}
+
+	return queueName + "." + tenant
+}
+
+// tenantRetryQueue names the queue failed orders of tenant wait in
+func tenantRetryQueue(tenant string) string {
+	return tenantQueue(tenant) + ".retry"
+}
+
+// tenantKeys returns the routing keys the orders of tenant are published with
+func tenantKeys(tenant string) []string {
+	if tenant == "" {
+		return routingKeys
+	}
+
+	keys := make([]string, 0, len(routingKeys))
+	for _, key := range routingKeys {
+		keys = append(keys, key+"."+tenant)
+	}
+
+	return keys
+}